@@ -7,6 +7,7 @@ require (
 	github.com/google/go-cmp v0.5.4 // indirect
 	github.com/natefinch/lumberjack v0.0.0-20201021141957-47ffae23317c
 	go.uber.org/zap v1.16.0
+	golang.org/x/crypto v0.0.0-20190510104115-cbcb75029529
 	gopkg.in/square/go-jose.v2 v2.5.1
 	gopkg.in/yaml.v2 v2.2.2
 )
@@ -0,0 +1,215 @@
+// Copyright 2020 The CupX Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xacme
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"strings"
+
+	"gopkg.in/square/go-jose.v2"
+)
+
+func (c *client) GetAccount(ctx context.Context) (*Account, error) {
+
+	acct := c.account()
+	if acct == nil || acct.AcctURL == "" {
+		return nil, errors.New("cupx/xacme.client.GetAccount: account is not set")
+	}
+
+	respb, _, err := c.acmePost(ctx, acct.AcctURL, "")
+	if err != nil {
+		return nil, err
+	}
+
+	return c.updateAccount(acct, respb)
+}
+
+func (c *client) UpdateContacts(ctx context.Context, emails []string) (*Account, error) {
+
+	acct := c.account()
+	if acct == nil || acct.AcctURL == "" {
+		return nil, errors.New("cupx/xacme.client.UpdateContacts: account is not set")
+	}
+
+	var contact []string
+	for _, v := range emails {
+		contact = append(contact, "mailto:"+v)
+	}
+
+	// an empty list removes all contacts, so it must not be omitted.
+	var p interface{} = &IdlReqUpdateAccountPayload{Contact: contact}
+	if len(contact) == 0 {
+		p = "{\"contact\":[]}"
+	}
+
+	respb, _, err := c.acmePost(ctx, acct.AcctURL, p)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.updateAccount(acct, respb)
+}
+
+func (c *client) DeactivateAccount(ctx context.Context) error {
+
+	acct := c.account()
+	if acct == nil || acct.AcctURL == "" {
+		return errors.New("cupx/xacme.client.DeactivateAccount: account is not set")
+	}
+
+	respb, _, err := c.acmePost(ctx, acct.AcctURL, &IdlReqUpdateAccountPayload{Status: "deactivated"})
+	if err != nil {
+		return err
+	}
+
+	_, err = c.updateAccount(acct, respb)
+	return err
+}
+
+func (c *client) FindAccountByKey(ctx context.Context, pemKey string) (*Account, error) {
+
+	nc := c.clone()
+	acct, err := nc.SetAccount(&Account{PemPrivateKey: pemKey})
+	if err != nil {
+		return nil, err
+	}
+
+	respb, resp, err := nc.acmePost(ctx, nc.caMeta.NewAcctURL, &IdlReqNewAccountPayload{OnlyReturnExisting: true})
+	if err != nil {
+		return nil, err
+	}
+
+	acct.AcctURL = resp.Header.Get("Location")
+	if acct.AcctURL == "" {
+		return nil, errors.New("cupx/xacme.client.FindAccountByKey: no account URL returned")
+	}
+	err = acct.update(respb)
+	if err != nil {
+		return nil, err
+	}
+
+	c.setAccount(acct)
+
+	return acct.clone(), nil
+}
+
+// updateAccount swaps in a copy of the account of c updated with respb, the account object
+// returned for acct, and returns another copy of it. The copy is made of the current account, so that a key rolled over
+// meanwhile is kept, unless the account was replaced by another one.
+func (c *client) updateAccount(acct *Account, respb []byte) (*Account, error) {
+	c.acctMu.Lock()
+	defer c.acctMu.Unlock()
+
+	cur := acct
+	if c.acct != nil && c.acct.AcctURL == acct.AcctURL {
+		cur = c.acct
+	}
+	nacct := *cur
+	err := nacct.update(respb)
+	if err != nil {
+		return nil, err
+	}
+	if cur == c.acct {
+		c.acct = &nacct
+	}
+
+	return nacct.clone(), nil
+}
+
+// clone returns a copy of acct which may be modified without affecting acct.
+func (acct *Account) clone() *Account {
+	nacct := *acct
+	nacct.Contact = append([]string(nil), acct.Contact...)
+	return &nacct
+}
+
+// update updates acct with the account object returned by the acme server.
+func (acct *Account) update(respb []byte) error {
+	if len(respb) == 0 {
+		return nil
+	}
+
+	idl := &IdlRespNewAccount{}
+	err := json.Unmarshal(respb, idl)
+	if err != nil {
+		return err
+	}
+
+	if idl.Status != "" {
+		acct.Status = idl.Status
+	}
+	if idl.Orders != "" {
+		acct.OrdersURL = idl.Orders
+	}
+	if idl.Contact != nil {
+		acct.Contact = nil
+		for _, v := range idl.Contact {
+			acct.Contact = append(acct.Contact, strings.TrimPrefix(v, "mailto:"))
+		}
+	}
+
+	return nil
+}
+
+func (c *client) RolloverAccountKey(ctx context.Context, newKey crypto.Signer) (*Account, error) {
+
+	old := c.account()
+	if old == nil || old.AcctURL == "" {
+		return nil, errors.New("cupx/xacme.client.RolloverAccountKey: account is not set")
+	}
+	if c.caMeta.KeyChangeURL == "" {
+		return nil, errors.New("cupx/xacme.client.RolloverAccountKey: the CA does not support key change")
+	}
+
+	if newKey == nil {
+		var err error
+		newKey, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+	}
+	pemKey, err := MarshalPemPrivateKey(newKey)
+	if err != nil {
+		return nil, err
+	}
+
+	// the inner JWS is signed by the new key and carries no nonce, see rfc8555 section 7.3.5.
+	inner, err := signPayloadWithKey(newKey, "", nil, c.caMeta.KeyChangeURL, &IdlReqKeyChangePayload{
+		Account: old.AcctURL,
+		OldKey:  jose.JSONWebKey{Key: joseKey(old.PrivateKey.Public())},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	_, _, err = c.acmePost(ctx, c.caMeta.KeyChangeURL, inner)
+	if err != nil {
+		return nil, err
+	}
+
+	// the CA accepted the new key, switch to it. The account is copied, so that requests
+	// signed concurrently use either the old key or the new one with its pem.
+	acct := *old
+	acct.PrivateKey, acct.PemPrivateKey = newKey, pemKey
+	c.setAccount(&acct)
+
+	return &acct, nil
+}
@@ -0,0 +1,307 @@
+// Copyright 2020 The CupX Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xacme
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"net/http"
+	"testing"
+
+	"gopkg.in/square/go-jose.v2"
+)
+
+func TestClient_RolloverAccountKey(t *testing.T) {
+	ca := newFakeCA(t)
+	reject := false
+	ca.handle("/key-change", func(w http.ResponseWriter, r *fakeCAReq) {
+		if reject {
+			ca.problem(w, http.StatusConflict, "malformed", "key in use")
+			return
+		}
+		inner, err := jose.ParseSigned(string(r.Payload))
+		if err != nil {
+			t.Fatal(err)
+		}
+		h := inner.Signatures[0].Protected
+		if h.ExtraHeaders["url"] != r.URL || h.Nonce != "" || h.JSONWebKey == nil {
+			t.Errorf("inner header = %+v", h)
+		}
+		b, err := inner.Verify(h.JSONWebKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p := &IdlReqKeyChangePayload{}
+		decodeJSON(t, b, p)
+
+		ca.mu.Lock()
+		defer ca.mu.Unlock()
+		old := ca.accounts[r.KeyID]
+		tp1, _ := old.Thumbprint(crypto.SHA256)
+		tp2, _ := p.OldKey.Thumbprint(crypto.SHA256)
+		if p.Account != r.KeyID || string(tp1) != string(tp2) {
+			t.Errorf("payload = %+v", p)
+		}
+		ca.accounts[r.KeyID] = h.JSONWebKey
+	})
+	ca.handle("/ping", func(w http.ResponseWriter, r *fakeCAReq) {})
+	ca.handle("/acct/1", func(w http.ResponseWriter, r *fakeCAReq) {
+		_, _ = w.Write([]byte(`{"status":"valid"}`))
+	})
+
+	c := ca.newClient()
+	oldAcct := c.acct
+	oldKey := c.acct.PrivateKey
+	oldPem := c.acct.PemPrivateKey
+
+	reject = true
+	if _, err := c.RolloverAccountKey(context.Background(), nil); err == nil {
+		t.Error("RolloverAccountKey() rejected err = nil")
+	}
+	if c.acct.PrivateKey != oldKey || c.acct.PemPrivateKey != oldPem {
+		t.Error("account key changed after rejected rollover")
+	}
+
+	reject = false
+	newKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	// clones in use keep signing and the account is fetched while the key is swapped.
+	stop := make(chan struct{})
+	signed := make(chan struct{})
+	go func() {
+		defer close(signed)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			if _, err := c.clone().keyAuthorization("token"); err != nil {
+				t.Error(err)
+				return
+			}
+			// signed with the old key once the CA switched, it may be rejected.
+			_, _ = c.GetAccount(context.Background())
+		}
+	}()
+	acct, err := c.RolloverAccountKey(context.Background(), newKey)
+	close(stop)
+	<-signed
+	if err != nil {
+		t.Fatal(err)
+	}
+	if acct.PrivateKey != newKey || acct.PemPrivateKey == oldPem || c.account().PrivateKey != newKey {
+		t.Error("account key not updated")
+	}
+	if oldAcct.PrivateKey != oldKey || oldAcct.PemPrivateKey != oldPem {
+		t.Error("the previous account is modified")
+	}
+	parsed, err := ParsePemPrivateKey(acct.PemPrivateKey)
+	if k, ok := parsed.(*ecdsa.PrivateKey); err != nil || !ok || k.D.Cmp(newKey.D) != 0 {
+		t.Errorf("PemPrivateKey does not match the new key, err = %v", err)
+	}
+
+	// requests are signed with the new key.
+	if _, _, err := c.acmePost(context.Background(), ca.url("/ping"), nil); err != nil {
+		t.Error(err)
+	}
+	if got, err := c.GetAccount(context.Background()); err != nil || got.PrivateKey != newKey || got.Status != "valid" {
+		t.Errorf("GetAccount() = %+v, %v, want the account with the new key", got, err)
+	}
+}
+
+func TestClient_AccountLifecycle(t *testing.T) {
+	ca := newFakeCA(t)
+	var contact []string
+	status := "valid"
+	ca.handle("/acct/1", func(w http.ResponseWriter, r *fakeCAReq) {
+		if r.KeyID != ca.url("/acct/1") {
+			ca.problem(w, http.StatusUnauthorized, "unauthorized", "wrong account")
+			return
+		}
+		if len(r.Payload) > 0 {
+			p := &IdlReqUpdateAccountPayload{}
+			decodeJSON(t, r.Payload, p)
+			if p.Contact != nil {
+				contact = p.Contact
+			}
+			if p.Status != "" {
+				status = p.Status
+			}
+		}
+		b, _ := json.Marshal(&IdlRespNewAccount{Status: status, Contact: contact, Orders: ca.url("/acct/1/orders")})
+		_, _ = w.Write(b)
+	})
+
+	c := ca.newClient()
+	pemKey := c.acct.PemPrivateKey
+
+	acct, err := c.UpdateContacts(context.Background(), []string{"a@test.xdns.cupx.net", "b@test.xdns.cupx.net"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(contact) != 2 || contact[0] != "mailto:a@test.xdns.cupx.net" {
+		t.Errorf("server contact = %v", contact)
+	}
+
+	// the returned account is a copy.
+	acct.Contact[0], acct.OrdersURL = "changed@test.xdns.cupx.net", ""
+	if got := c.account(); got.Contact[0] != "a@test.xdns.cupx.net" || got.OrdersURL != ca.url("/acct/1/orders") {
+		t.Errorf("account in use = %+v, modified through the returned copy", got)
+	}
+	acct, err = c.GetAccount(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if acct.Status != "valid" || acct.OrdersURL != ca.url("/acct/1/orders") ||
+		len(acct.Contact) != 2 || acct.Contact[1] != "b@test.xdns.cupx.net" {
+		t.Errorf("GetAccount() = %+v", acct)
+	}
+
+	c2, err := NewClient(context.Background(), &Config{DirURL: ca.url("/dir")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	found, err := c2.FindAccountByKey(context.Background(), pemKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found.AcctURL != ca.url("/acct/1") {
+		t.Errorf("FindAccountByKey().AcctURL = %v", found.AcctURL)
+	}
+	found.AcctURL = ""
+	if c2.(*client).account().AcctURL != ca.url("/acct/1") {
+		t.Error("FindAccountByKey() returned the account in use")
+	}
+
+	otherKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	otherPem, _ := MarshalPemPrivateKey(otherKey)
+	if _, err := c2.FindAccountByKey(context.Background(), otherPem); !errors.Is(err, ErrAccountDoesNotExist) {
+		t.Errorf("FindAccountByKey() unknown key err = %v, want %v", err, ErrAccountDoesNotExist)
+	}
+
+	if err := c2.DeactivateAccount(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got := c2.(*client).account(); status != "deactivated" || got.Status != "deactivated" {
+		t.Errorf("status = %v, account status = %v", status, got.Status)
+	}
+}
+
+func TestClient_CreateAccountTOS(t *testing.T) {
+	ca := newFakeCA(t)
+	ca.meta = `{"termsOfService":"https://ca.test.xdns.cupx.net/tos"}`
+
+	c, err := NewClient(context.Background(), &Config{DirURL: ca.url("/dir")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.CreateAccountWithEmail(context.Background(), "acme@test.xdns.cupx.net", false); err != ErrTermsOfServiceNotAgreed {
+		t.Errorf("CreateAccountWithEmail() err = %v, want %v", err, ErrTermsOfServiceNotAgreed)
+	}
+
+	ca.meta = `{}`
+	c, err = NewClient(context.Background(), &Config{DirURL: ca.url("/dir")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.CreateAccountWithEmail(context.Background(), "acme@test.xdns.cupx.net", false); !errors.Is(err, ErrUserActionRequired) {
+		t.Errorf("CreateAccountWithEmail() err = %v, want %v", err, ErrUserActionRequired)
+	}
+}
+
+func TestClient_AccountKeyTypes(t *testing.T) {
+	ca := newFakeCA(t)
+	var alg string
+	ca.handle("/ping", func(w http.ResponseWriter, r *fakeCAReq) {
+		alg = r.Alg
+	})
+
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+	pkcs8, _ := x509.MarshalPKCS8PrivateKey(edKey)
+	sec1, _ := x509.MarshalECPrivateKey(ecKey)
+	tests := []struct {
+		name   string
+		pemKey string
+		alg    string
+	}{
+		{"pkcs1 rsa", string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)})), "RS256"},
+		{"sec1 p384", string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: sec1})), "ES384"},
+		{"pkcs8 ed25519", string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: pkcs8})), "EdDSA"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := NewClient(context.Background(), &Config{DirURL: ca.url("/dir")})
+			if err != nil {
+				t.Fatal(err)
+			}
+			acct, err := c.CreateAccountWithPrivateKey(context.Background(), &Account{PemPrivateKey: tt.pemKey, TOSAgreed: true})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if acct.AcctURL == "" || acct.PemPrivateKey != tt.pemKey {
+				t.Errorf("CreateAccountWithPrivateKey() = %+v", acct)
+			}
+			if _, _, err := c.(*client).acmePost(context.Background(), ca.url("/ping"), nil); err != nil {
+				t.Fatal(err)
+			}
+			if alg != tt.alg {
+				t.Errorf("alg = %v, want %v", alg, tt.alg)
+			}
+			if ka, err := c.(*client).keyAuthorization("token"); err != nil || len(ka) <= len("token.") {
+				t.Errorf("keyAuthorization() = %q, %v, want the token and the thumbprint", ka, err)
+			}
+		})
+	}
+	if _, err := GetJWKThumbprintWithBase64url("not a key"); err == nil {
+		t.Error("GetJWKThumbprintWithBase64url() of an unsupported key err = nil")
+	}
+
+	smallKey, _ := rsa.GenerateKey(rand.Reader, 1024)
+	smallPem := string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(smallKey)}))
+	c, _ := NewClient(context.Background(), &Config{DirURL: ca.url("/dir")})
+	if _, err := c.SetAccount(&Account{PemPrivateKey: smallPem}); err == nil {
+		t.Error("SetAccount() with rsa 1024 key err = nil")
+	}
+
+	// the account key can be rolled over to another key type.
+	c = ca.newClient()
+	ca.handle("/key-change", func(w http.ResponseWriter, r *fakeCAReq) {
+		inner, _ := jose.ParseSigned(string(r.Payload))
+		h := inner.Signatures[0].Protected
+		if h.Algorithm != "RS256" {
+			t.Errorf("inner alg = %v", h.Algorithm)
+		}
+		ca.mu.Lock()
+		ca.accounts[r.KeyID] = h.JSONWebKey
+		ca.mu.Unlock()
+	})
+	if _, err := c.RolloverAccountKey(context.Background(), rsaKey); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := c.(*client).acmePost(context.Background(), ca.url("/ping"), nil); err != nil || alg != "RS256" {
+		t.Errorf("acmePost() after rollover alg = %v, err = %v", alg, err)
+	}
+}
@@ -18,19 +18,20 @@ package xacme
 
 import (
 	"bytes"
+	"context"
+	"crypto"
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rand"
-	"crypto/rsa"
 	"crypto/x509"
-	"crypto/x509/pkix"
-	"encoding/base64"
 	"encoding/json"
 	"encoding/pem"
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"strings"
 	"sync"
 	"time"
 
@@ -49,27 +50,58 @@ const (
 
 // CaMeta contains the Directory URL.
 type CaMeta struct {
-	DirURL      string
-	NewAcctURL  string
-	NewOrderURL string
-	NewNonceURL string
-}
-
-var caAcmeDirMap = map[string]string{
-	CaLetsencrypt:        "https://acme-v02.api.letsencrypt.org/directory",
-	CaLetsencryptStaging: "https://acme-staging-v02.api.letsencrypt.org/directory",
+	DirURL         string
+	NewAcctURL     string
+	NewOrderURL    string
+	NewNonceURL    string
+	RevokeCertURL  string
+	KeyChangeURL   string
+	RenewalInfoURL string
 }
 
 // Client is the acme client interface.
 type Client interface {
 	// CreateAccountWithEmail create acme account with email.
-	CreateAccountWithEmail(email string, TOSAgreed bool) (*Account, error)
+	CreateAccountWithEmail(ctx context.Context, email string, TOSAgreed bool, opts ...Option) (*Account, error)
 	// SetAccount set Account for acme client.
 	SetAccount(acct *Account) (*Account, error)
 	// CreateAccountWithPrivateKey create acme account with private key.
-	CreateAccountWithPrivateKey(acct *Account) (*Account, error)
+	CreateAccountWithPrivateKey(ctx context.Context, acct *Account, opts ...Option) (*Account, error)
+	// SignCert sign certificate with the solvers set by WithSolver and WithIdentifierSolver.
+	SignCert(ctx context.Context, sr *IdlSignReq, opts ...Option) (*CertInfo, error)
+	// SignCertWithCSR sign certificate of the DER encoded PKCS#10 csr with the solvers set by
+	// WithSolver and WithIdentifierSolver. The identifiers are taken from the csr and
+	// the returned CertInfo has no private key.
+	SignCertWithCSR(ctx context.Context, csr []byte, opts ...Option) (*CertInfo, error)
 	// SignCertWithDNS sign certificate with dns-01 Challenge.
-	SignCertWithDNS(sr *IdlSignReq, opts ...Option) (*CertInfo, error)
+	SignCertWithDNS(ctx context.Context, sr *IdlSignReq, opts ...Option) (*CertInfo, error)
+	// SignCertWithHTTP sign certificate with http-01 Challenge.
+	SignCertWithHTTP(ctx context.Context, sr *IdlSignReq, opts ...Option) (*CertInfo, error)
+	// SignCertWithTLSALPN sign certificate with tls-alpn-01 Challenge.
+	SignCertWithTLSALPN(ctx context.Context, sr *IdlSignReq, opts ...Option) (*CertInfo, error)
+	// RevokeCert revokes the pem encoded certificate with a rfc5280 reason code.
+	// It is signed with the account key unless WithRevocationKey is set.
+	// Errors of the acme server match ErrAlreadyRevoked and ErrUnauthorized with errors.Is.
+	RevokeCert(ctx context.Context, certPEM string, reason int, opts ...Option) error
+	// RolloverAccountKey replaces the account key with newKey, a new P-256 key is generated if newKey is nil.
+	// The account is only updated after the CA accepts the new key. The returned account is a
+	// copy with the new key, the Account in use before is left unchanged.
+	RolloverAccountKey(ctx context.Context, newKey crypto.Signer) (*Account, error)
+	// GetAccount fetches the status, contacts and orders URL of the account.
+	// The returned account is a copy, modifying it doesn't affect the account in use.
+	GetAccount(ctx context.Context) (*Account, error)
+	// UpdateContacts replaces the email contacts of the account, it returns a copy of the account.
+	UpdateContacts(ctx context.Context, emails []string) (*Account, error)
+	// DeactivateAccount deactivates the account, it can't be used afterwards.
+	DeactivateAccount(ctx context.Context) error
+	// FindAccountByKey looks up the existing account of the pem private key and sets it for acme client.
+	// It returns ErrAccountDoesNotExist if the CA doesn't know the key. The returned account is a copy.
+	FindAccountByKey(ctx context.Context, pemKey string) (*Account, error)
+	// GetRenewalInfo fetches the acme renewal information of the pem encoded certificate.
+	// It returns ErrRenewalInfoUnsupported if the CA doesn't publish renewal information.
+	GetRenewalInfo(ctx context.Context, certPEM string) (*RenewalInfo, error)
+	// Directory returns the directory of the acme server.
+	Directory() *IdlRespDir
 }
 
 // Option configures option.
@@ -77,6 +109,17 @@ type Option func(opt *option)
 
 type option struct {
 	RootCAKeyID string
+	solvers     []solverEntry
+	eab         *ExternalAccountBinding
+	keyType     KeyType
+	certSigner  crypto.Signer
+	retry       *RetryPolicy
+	// revocationKey is the pem encoded certificate key signing RevokeCert.
+	revocationKey string
+	// replaces is the ARI certificate ID set as the replaces field of new orders.
+	replaces string
+	// storage stores the issued certificates.
+	storage Storage
 }
 
 // WithRootCAKeyID chooses which Root CA to use.
@@ -87,30 +130,39 @@ func WithRootCAKeyID(id string) Option {
 }
 
 type acmeNonce struct {
-	nonce    string
-	nonceMu  sync.Mutex
-	nonceURL string
+	nonce      string
+	nonceMu    sync.Mutex
+	nonceURL   string
+	httpClient *http.Client
 }
 
 func NewAcmeNonce(url string) *acmeNonce {
-	an := &acmeNonce{nonceURL: url, nonceMu: sync.Mutex{}}
+	an := &acmeNonce{nonceURL: url, nonceMu: sync.Mutex{}, httpClient: http.DefaultClient}
 	return an
 }
+
+// Nonce implements jose.NonceSource.
 func (an *acmeNonce) Nonce() (nonce string, err error) {
+	return an.NonceWithContext(context.Background())
+}
+
+// NonceWithContext returns a cached nonce, or fetches a new one with ctx.
+func (an *acmeNonce) NonceWithContext(ctx context.Context) (nonce string, err error) {
 	nonce = an.getCachedNonce()
 	if nonce != "" {
 		return
 	}
 
-	req, err := http.NewRequest(http.MethodHead, an.nonceURL, nil)
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, an.nonceURL, nil)
 	if err != nil {
 		return
 	}
 
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := an.httpClient.Do(req)
 	if err != nil {
 		return
 	}
+	_ = resp.Body.Close()
 
 	nonce = resp.Header.Get("Replay-Nonce")
 
@@ -136,58 +188,95 @@ func (an *acmeNonce) cacheNonce(nonce string) {
 	an.nonce = nonce
 }
 
+// withContext returns a jose.NonceSource fetching nonces with ctx.
+func (an *acmeNonce) withContext(ctx context.Context) jose.NonceSource {
+	return &ctxNonce{an: an, ctx: ctx}
+}
+
+type ctxNonce struct {
+	an  *acmeNonce
+	ctx context.Context
+}
+
+func (n *ctxNonce) Nonce() (string, error) {
+	return n.an.NonceWithContext(n.ctx)
+}
+
 type client struct {
-	ca         string
-	acct       *Account
-	httpClient http.Client
+	ca   string
+	acct *Account
+	// acctMu guards acct, which RolloverAccountKey swaps while clones of the client are in use.
+	acctMu     *sync.RWMutex
+	httpClient *http.Client
 	nonce      *acmeNonce
 	dns        *xdns.Config
+	dnsZones   map[string]*xdns.Config
+	http       HTTPChallengeStore
+	tlsalpn    *TLSALPNResponder
 	caMeta     *CaMeta
+	dir        *IdlRespDir
 	opt        option
 }
 
 // Config configures a Client when creating.
 type Config struct {
-	CA  string
-	Dns *xdns.Config
+	// CA is the name of a CA registered with RegisterCA, e.g. CaLetsencrypt.
+	CA string
+	// DirURL is the directory URL of the acme server, it takes precedence over CA.
+	DirURL string
+	// HTTPClient is used to talk to the acme server. It defaults to http.DefaultClient.
+	HTTPClient *http.Client
+	Dns        *xdns.Config
+	// DnsZones configures the dns provider of each zone for SignCertWithDNS, the longest zone
+	// the TXT record is in wins over shorter ones and over Dns.
+	DnsZones map[string]*xdns.Config
+	// HTTP stores key authorizations of http-01 challenges, it is required by SignCertWithHTTP.
+	HTTP HTTPChallengeStore
+	// TLSALPN answers tls-alpn-01 challenges, it is required by SignCertWithTLSALPN.
+	TLSALPN *TLSALPNResponder
 }
 
-// NewClient return a acme client.
-func NewClient(conf *Config, opts ...Option) Client {
+// NewClient return a acme client, ctx is used to fetch the directory.
+func NewClient(ctx context.Context, conf *Config, opts ...Option) (Client, error) {
 
-	d, ok := caAcmeDirMap[conf.CA]
-	if !ok {
-		return nil
-	}
-	req, err := http.NewRequest(http.MethodGet, d, nil)
-	if err != nil {
-		return nil
-	}
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return nil
+	d := conf.DirURL
+	if d == "" {
+		var ok bool
+		d, ok = LookupCA(conf.CA)
+		if !ok {
+			return nil, errors.New("cupx/xacme.NewClient: unknown CA " + conf.CA)
+		}
 	}
-	respb, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return nil
+
+	httpClient := conf.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
 	}
 
-	idl := &IdlRespDir{}
-	err = json.Unmarshal(respb, idl)
+	idl, err := getDirectory(ctx, httpClient, d)
 	if err != nil {
-		return nil
+		return nil, err
 	}
 
-	return &client{
+	c := &client{
 		ca:         conf.CA,
-		httpClient: http.Client{},
+		acctMu:     new(sync.RWMutex),
+		httpClient: httpClient,
 		dns:        conf.Dns,
+		dnsZones:   conf.DnsZones,
+		http:       conf.HTTP,
+		tlsalpn:    conf.TLSALPN,
 		caMeta: &CaMeta{
-			NewAcctURL:  idl.NewAccount,
-			NewOrderURL: idl.NewOrder,
-			NewNonceURL: idl.NewNonce,
+			DirURL:        d,
+			NewAcctURL:    idl.NewAccount,
+			NewOrderURL:   idl.NewOrder,
+			NewNonceURL:   idl.NewNonce,
+			RevokeCertURL: idl.RevokeCert,
+			KeyChangeURL:  idl.KeyChange,
+			// the renewal info URL ends with a slash in some directories.
+			RenewalInfoURL: strings.TrimSuffix(idl.RenewalInfo, "/"),
 		},
-		nonce:  NewAcmeNonce(idl.NewNonce),
+		dir: idl,
 		opt: func() option {
 			o := new(option)
 			for _, opt := range opts {
@@ -196,15 +285,57 @@ func NewClient(conf *Config, opts ...Option) Client {
 			return *o
 		}(),
 	}
+	c.nonce = c.newNonce()
+
+	return c, nil
+}
+
+func getDirectory(ctx context.Context, httpClient *http.Client, url string) (*IdlRespDir, error) {
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	respb, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("cupx/xacme.getDirectory: %s returned status %d", url, resp.StatusCode)
+	}
+
+	idl := &IdlRespDir{}
+	err = json.Unmarshal(respb, idl)
+	if err != nil {
+		return nil, err
+	}
+	if idl.NewNonce == "" || idl.NewAccount == "" || idl.NewOrder == "" {
+		return nil, errors.New("cupx/xacme.getDirectory: invalid directory " + url)
+	}
+
+	return idl, nil
 }
 
 // Account contains acme account data.
 type Account struct {
-	Contact       []string
-	TOSAgreed     bool
-	AcctURL       string
-	PrivateKey    *ecdsa.PrivateKey
+	Contact   []string
+	TOSAgreed bool
+	AcctURL   string
+	// PrivateKey is an ecdsa P-256, P-384 or P-521, RSA or ed25519 key signing the requests
+	// with ES256, ES384, ES512, RS256 or EdDSA. Not every CA accepts EdDSA.
+	PrivateKey crypto.Signer
+	// PemPrivateKey is the PKCS#1, PKCS#8 or SEC1 pem encoding of PrivateKey.
 	PemPrivateKey string
+	// Status is one of valid, deactivated and revoked, it is updated by the account operations.
+	Status string
+	// OrdersURL is the URL of the orders list of the account.
+	OrdersURL string
 }
 
 // Account contains signed cert info.
@@ -217,157 +348,311 @@ type CertInfo struct {
 	NotBefore            string
 	NotAfter             string
 	RootCAKeyID          string
+	// KeyType is the type of the certificate key, it is empty for other key types.
+	// PemCertPrivateKey is PKCS#8 encoded, and empty if the key is not generated by xacme.
+	KeyType KeyType
+}
+
+func (c *client) Directory() *IdlRespDir {
+	dir := *c.dir
+	dir.Meta.CaaIdentities = append([]string(nil), c.dir.Meta.CaaIdentities...)
+	return &dir
 }
 
 func (c *client) SetAccount(acct *Account) (*Account, error) {
 
 	if acct.PemPrivateKey != "" {
-		block, _ := pem.Decode([]byte(acct.PemPrivateKey))
-		privateKey, err := x509.ParseECPrivateKey(block.Bytes)
+		privateKey, err := ParsePemPrivateKey(acct.PemPrivateKey)
+		if err != nil {
+			return nil, err
+		}
+		_, err = jwsAlgorithm(privateKey)
 		if err != nil {
 			return nil, err
 		}
 		acct.PrivateKey = privateKey
 	}
 
-	c.acct = acct
+	c.setAccount(acct)
 
-	return c.acct, nil
+	return acct, nil
 }
 
-func (c *client) CreateAccountWithEmail(email string, TOSAgreed bool) (*Account, error) {
-	c.acct = &Account{
+func (c *client) CreateAccountWithEmail(ctx context.Context, email string, TOSAgreed bool, opts ...Option) (*Account, error) {
+	c.setAccount(&Account{
 		Contact:   []string{email},
 		TOSAgreed: TOSAgreed,
-	}
+	})
 
-	err := c.newAccount()
+	err := c.newAccount(ctx, opts...)
 	if err != nil {
 		return nil, err
 	}
 
-	return c.acct, nil
+	return c.account(), nil
 }
 
-func (c *client) CreateAccountWithPrivateKey(acct *Account) (*Account, error) {
+func (c *client) CreateAccountWithPrivateKey(ctx context.Context, acct *Account, opts ...Option) (*Account, error) {
 
 	_, err := c.SetAccount(acct)
 	if err != nil {
 		return nil, err
 	}
 
-	err = c.newAccount()
+	err = c.newAccount(ctx, opts...)
 	if err != nil {
 		return nil, err
 	}
 
-	return c.acct, nil
+	return c.account(), nil
 }
 
-func (c *client) SignCertWithDNS(sr *IdlSignReq, opts ...Option) (*CertInfo, error) {
+func (c *client) SignCert(ctx context.Context, sr *IdlSignReq, opts ...Option) (*CertInfo, error) {
 
 	nc := c.clone()
 	for _, opt := range opts {
 		opt(&nc.opt)
 	}
-	// new order.
-	o := &IdlReqNewOrderPayload{
-		Identifiers: sr.Identifiers,
+
+	return nc.signCert(ctx, sr)
+}
+
+func (c *client) SignCertWithDNS(ctx context.Context, sr *IdlSignReq, opts ...Option) (*CertInfo, error) {
+
+	if c.dns == nil && len(c.dnsZones) == 0 {
+		return nil, errors.New("cupx/xacme.client.SignCertWithDNS: dns is not configured")
+	}
+	for _, identifier := range sr.Identifiers {
+		if identifier.Type == IdentifierTypeIP {
+			return nil, fmt.Errorf("cupx/xacme.client.SignCertWithDNS: %w: %s", ErrIPIdentifierDNS01, identifier.Value)
+		}
+	}
+	var dns xdns.XDns
+	if c.dns != nil {
+		dns = xdns.NewXDns(c.dns)
+		if dns == nil {
+			return nil, errors.New("cupx/xacme.client.SignCertWithDNS: dns type not supported: " + c.dns.Type)
+		}
+	}
+
+	s := NewDNSSolver(dns, sr.TXTCname)
+	s.TXTCnames = sr.TXTCnames
+	s.Providers = make(map[string]xdns.XDns)
+	for zone, conf := range c.dnsZones {
+		s.Providers[zone] = xdns.NewXDns(conf)
+		if s.Providers[zone] == nil {
+			return nil, errors.New("cupx/xacme.client.SignCertWithDNS: dns type of zone " + zone + " not supported: " + conf.Type)
+		}
+	}
+
+	return c.SignCert(ctx, sr, append([]Option{WithSolver(ChallengeTypeDNS01, s)}, opts...)...)
+}
+
+func (c *client) SignCertWithHTTP(ctx context.Context, sr *IdlSignReq, opts ...Option) (*CertInfo, error) {
+
+	if c.http == nil {
+		return nil, errors.New("cupx/xacme.client.SignCertWithHTTP: http challenge store is not configured")
+	}
+
+	return c.SignCert(ctx, sr, append([]Option{WithSolver(ChallengeTypeHTTP01, NewHTTPSolver(c.http))}, opts...)...)
+}
+
+func (c *client) SignCertWithTLSALPN(ctx context.Context, sr *IdlSignReq, opts ...Option) (*CertInfo, error) {
+
+	if c.tlsalpn == nil {
+		return nil, errors.New("cupx/xacme.client.SignCertWithTLSALPN: tls-alpn responder is not configured")
+	}
+
+	return c.SignCert(ctx, sr, append([]Option{WithSolver(ChallengeTypeTLSALPN01, c.tlsalpn)}, opts...)...)
+}
+
+func (c *client) SignCertWithCSR(ctx context.Context, csr []byte, opts ...Option) (*CertInfo, error) {
+
+	req, err := x509.ParseCertificateRequest(csr)
+	if err != nil {
+		return nil, err
+	}
+	err = req.CheckSignature()
+	if err != nil {
+		return nil, err
+	}
+
+	identifiers := CsrIdentifiers(req)
+	if len(identifiers) == 0 {
+		return nil, errors.New("cupx/xacme.client.SignCertWithCSR: no identifier found in csr")
+	}
+
+	nc := c.clone()
+	for _, opt := range opts {
+		opt(&nc.opt)
 	}
-	oResp, err := nc.newOrder(o)
+
+	return nc.issue(ctx, identifiers, csr, "")
+}
+
+func (c *client) signCert(ctx context.Context, sr *IdlSignReq) (*CertInfo, error) {
+
+	identifiers, err := normalizeIdentifiers(sr.Identifiers)
 	if err != nil {
 		return nil, err
 	}
+	nsr := *sr
+	nsr.Identifiers = identifiers
 
-	// validate identifier with dns.
-	err = nc.validateIdentifierWithDNS(oResp.Authorizations, sr.TXTCname)
+	// create csr.
+	csr, pri, err := c.getCsr(&nsr)
 	if err != nil {
 		return nil, err
 	}
 
-	// create csp.
-	csr, pri, err := nc.getCsrUseSHA256WithRSA(sr)
-	pemPri := string(pem.EncodeToMemory(&pem.Block{
-		Type: "RSA PRIVATE KEY",
-		Bytes: func() []byte {
-			priB := x509.MarshalPKCS1PrivateKey(pri)
-			if err != nil {
-				return nil
-			}
-			return priB
-		}(),
-	}))
+	var pemPri string
+	if c.opt.certSigner == nil {
+		pemPri, err = marshalPKCS8PemPrivateKey(pri)
+		if err != nil {
+			return nil, err
+		}
+	}
 
-	// request certificate.
-	fRespB, _, err := nc.acmePost(oResp.Finalize, fmt.Sprintf("{\"csr\":\"%s\"}", csr))
+	return c.issue(ctx, nsr.Identifiers, csr, pemPri)
+}
 
-	// download certificate.
-	fResp := &IdlRespFinalize{}
-	err = json.Unmarshal(fRespB, fResp)
+// issue orders a certificate of identifiers with the DER encoded csr.
+func (c *client) issue(ctx context.Context, identifiers []IdlIdentifier, csr []byte, pemPri string) (*CertInfo, error) {
+
+	// new order.
+	o := &IdlReqNewOrderPayload{
+		Identifiers: identifiers,
+		Replaces:    c.opt.replaces,
+	}
+	oResp, orderURL, err := c.newOrder(ctx, o)
 	if err != nil {
 		return nil, err
 	}
-	if fResp.Status == "valid" {
-		return nc.getCertFromURL(fResp.Certificate, pemPri)
+
+	// validate identifier and request certificate.
+	oResp, err = c.finishOrder(ctx, orderURL, oResp, csr)
+	if err != nil {
+		return nil, err
 	}
 
-	return nil, errors.New("order status not valid")
+	// download certificate.
+	cert, err := c.getCertFromURL(ctx, oResp.Certificate, pemPri)
+	if err != nil {
+		return nil, err
+	}
+	if c.opt.storage != nil {
+		err = StoreCert(ctx, c.opt.storage, CertName(identifiers), cert)
+		if err != nil {
+			return cert, fmt.Errorf("cupx/xacme.client.issue: store certificate: %w", err)
+		}
+	}
+	return cert, nil
 }
 
-func (c *client) newAccount() error {
+func (c *client) newAccount(ctx context.Context, opts ...Option) error {
+
+	o := c.opt
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.eab == nil && c.dir.Meta.ExternalAccountRequired {
+		return fmt.Errorf("cupx/xacme.client.newAccount: %w", ErrExternalAccountRequired)
+	}
+	// the account is set once created, a copy is prepared so that a failed creation
+	// leaves the account of c unchanged.
+	acct := *c.account()
+	if !acct.TOSAgreed && c.dir.Meta.TermsOfService != "" {
+		return ErrTermsOfServiceNotAgreed
+	}
 
-	if c.acct.PrivateKey == nil {
+	if acct.PrivateKey == nil {
 
 		privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
 		if err != nil {
 			return err
 		}
-		c.acct.PrivateKey = privateKey
+		acct.PrivateKey = privateKey
 	}
 
-	c.acct.PemPrivateKey = string(pem.EncodeToMemory(&pem.Block{
-		Type: "EC PRIVATE KEY",
-		Bytes: func() []byte {
-			prib, err := x509.MarshalECPrivateKey(c.acct.PrivateKey)
-			if err != nil {
-				return nil
-			}
-			return prib
-		}(),
-	}))
+	if acct.PemPrivateKey == "" {
+		pemKey, err := MarshalPemPrivateKey(acct.PrivateKey)
+		if err != nil {
+			return err
+		}
+		acct.PemPrivateKey = pemKey
+	}
 
 	var contact []string
-	for _, v := range c.acct.Contact {
+	for _, v := range acct.Contact {
 		contact = append(contact, "mailto:"+v)
 	}
 
 	payload := IdlReqNewAccountPayload{
-		TermsOfServiceAgreed: true,
+		TermsOfServiceAgreed: acct.TOSAgreed,
 		Contact:              contact,
 	}
 
-	c.acct.AcctURL = ""
-	_, resp, err := c.acmePost(c.caMeta.NewAcctURL, payload)
+	if o.eab != nil {
+		eab, err := signEAB(o.eab, acct.PrivateKey.Public(), c.caMeta.NewAcctURL)
+		if err != nil {
+			return err
+		}
+		payload.ExternalAccountBinding = eab
+	}
+
+	// the account URL is not known yet, the request carries the JWK of the key.
+	sign := func(nonce jose.NonceSource, url string, p interface{}) (string, error) {
+		return signPayloadWithKey(acct.PrivateKey, "", nonce, url, p)
+	}
+	respb, resp, err := c.acmePostWithSigner(ctx, c.caMeta.NewAcctURL, payload, sign)
 
 	if err != nil {
 		return err
 	}
 
-	c.acct.AcctURL = resp.Header.Get("Location")
+	acct.AcctURL = resp.Header.Get("Location")
+	err = acct.update(respb)
+	if err != nil {
+		return err
+	}
+	c.setAccount(&acct)
 
 	return nil
 }
 
 func (c *client) clone() *client {
+	c.acctMu.RLock()
 	nc := *c
-	nc.nonce = NewAcmeNonce(c.caMeta.NewNonceURL)
+	c.acctMu.RUnlock()
+	nc.nonce = c.newNonce()
 	return &nc
 }
-func (c *client) getCertFromURL(url string, pemPri string) (*CertInfo, error) {
+
+// account returns the account of c.
+func (c *client) account() *Account {
+	c.acctMu.RLock()
+	defer c.acctMu.RUnlock()
+	return c.acct
+}
+
+// setAccount replaces the account of c. The account is swapped rather than modified, as
+// clones of c share it.
+func (c *client) setAccount(acct *Account) {
+	c.acctMu.Lock()
+	defer c.acctMu.Unlock()
+	c.acct = acct
+}
+
+func (c *client) newNonce() *acmeNonce {
+	an := NewAcmeNonce(c.caMeta.NewNonceURL)
+	an.httpClient = c.httpClient
+	return an
+}
+func (c *client) getCertFromURL(ctx context.Context, url string, pemPri string) (*CertInfo, error) {
 
 	var certPems [][]byte
 
-	DcRespB, DcResp, err := c.acmePost(url, "")
+	DcRespB, DcResp, err := c.acmePost(ctx, url, "")
 	if err != nil {
 		return nil, err
 	}
@@ -377,7 +662,7 @@ func (c *client) getCertFromURL(url string, pemPri string) (*CertInfo, error) {
 
 	for _, link := range links {
 		if link.Rel == "alternate" {
-			DcRespB, _, err := c.acmePost(link.URL, "")
+			DcRespB, _, err := c.acmePost(ctx, link.URL, "")
 			if err != nil {
 				continue
 			}
@@ -386,41 +671,16 @@ func (c *client) getCertFromURL(url string, pemPri string) (*CertInfo, error) {
 	}
 
 	var certInfos []*CertInfo
-	for i, certPem := range certPems {
-		var cert509s []*x509.Certificate
-		var certBlocks []*pem.Block
-		for len(certPem) > 0 {
-			block, restPem := pem.Decode(certPem)
-			certPem = restPem
-			cert509, err := x509.ParseCertificate(block.Bytes)
-			if err != nil {
-				continue
-			}
-			cert509s = append(cert509s, cert509)
-			certBlocks = append(certBlocks, block)
-		}
-
-		certInfo := new(CertInfo)
-		if cert509s == nil || certBlocks == nil || len(cert509s) < 1 || len(certBlocks) < 1 {
+	for _, certPem := range certPems {
+		certInfo := newCertInfo(certPem, pemPri)
+		if certInfo == nil {
 			continue
 		}
-
-		certInfo.RootCAKeyID = FmtX509KeyID(cert509s[len(cert509s)-1].AuthorityKeyId)
 		if c.opt.RootCAKeyID != "" {
 			if certInfo.RootCAKeyID != c.opt.RootCAKeyID {
 				continue
 			}
 		}
-
-		certInfo.NotBefore = cert509s[0].NotBefore.UTC().Format(time.RFC3339)
-		certInfo.NotAfter = cert509s[0].NotAfter.UTC().Format(time.RFC3339)
-		certInfo.PemCertBodyWithChain = string(certPems[i])
-		certInfo.PemCertBody = string(pem.EncodeToMemory(certBlocks[0]))
-		for i := 1; i < len(certBlocks); i++ {
-			certInfo.PemCertChain += string(pem.EncodeToMemory(certBlocks[i]))
-		}
-		certInfo.SignatureAlgorithm = cert509s[0].SignatureAlgorithm.String()
-		certInfo.PemCertPrivateKey = pemPri
 		certInfos = append(certInfos, certInfo)
 	}
 	if len(certInfos) >= 1 {
@@ -430,173 +690,213 @@ func (c *client) getCertFromURL(url string, pemPri string) (*CertInfo, error) {
 	return nil, errors.New("failed to get certInfo")
 }
 
-func (c *client) validateIdentifierWithDNS(authzs []string, cname string) error {
+// newCertInfo returns the CertInfo of the pem encoded certificate chain with the private key pemPri,
+// nil if there is no certificate in the chain.
+func newCertInfo(certPem []byte, pemPri string) *CertInfo {
+	chainPem := certPem
+	var cert509s []*x509.Certificate
+	var certBlocks []*pem.Block
+	for len(certPem) > 0 {
+		block, restPem := pem.Decode(certPem)
+		if block == nil {
+			break
+		}
+		certPem = restPem
+		cert509, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			continue
+		}
+		cert509s = append(cert509s, cert509)
+		certBlocks = append(certBlocks, block)
+	}
+	if len(cert509s) < 1 {
+		return nil
+	}
+
+	certInfo := new(CertInfo)
+	certInfo.RootCAKeyID = FmtX509KeyID(cert509s[len(cert509s)-1].AuthorityKeyId)
+	certInfo.NotBefore = cert509s[0].NotBefore.UTC().Format(time.RFC3339)
+	certInfo.NotAfter = cert509s[0].NotAfter.UTC().Format(time.RFC3339)
+	certInfo.PemCertBodyWithChain = string(chainPem)
+	certInfo.PemCertBody = string(pem.EncodeToMemory(certBlocks[0]))
+	for i := 1; i < len(certBlocks); i++ {
+		certInfo.PemCertChain += string(pem.EncodeToMemory(certBlocks[i]))
+	}
+	certInfo.SignatureAlgorithm = cert509s[0].SignatureAlgorithm.String()
+	certInfo.PemCertPrivateKey = pemPri
+	certInfo.KeyType = keyTypeOf(cert509s[0].PublicKey)
+	return certInfo
+}
+
+func (c *client) validateIdentifier(ctx context.Context, authzs []string) error {
 
-	var wg sync.WaitGroup
-	for _, authz := range authzs {
-		wg.Add(1)
-		go func(authz string) {
-			defer wg.Done()
-			_ = c.dns01Challenge(authz, cname)
-		}(authz)
+	picked := make([]*authzChallenge, len(authzs))
+	err := forEach(len(authzs), func(i int) error {
+		ac, err := c.pickChallenge(ctx, authzs[i])
+		picked[i] = ac
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	var acs []*authzChallenge
+	for _, ac := range picked {
+		if ac != nil {
+			acs = append(acs, ac)
+		}
+	}
+	if err := c.solveChallenges(ctx, acs); err != nil {
+		return err
 	}
-	wg.Wait()
 	for _, authz := range authzs {
-		darResp, err := c.downloadAuthorizationResources(authz)
+		darResp, _, err := c.downloadAuthorizationResources(ctx, authz)
 		if err != nil {
 			return err
 		}
 		if darResp.Status != "valid" {
-			return fmt.Errorf("authorization err, status : %s", darResp.Status)
+			return newAuthorizationError(authz, darResp)
 		}
 	}
 	return nil
 }
 
-func (c *client) dns01Challenge(authz string, cname string) error {
-	darResp, err := c.downloadAuthorizationResources(authz)
+// keyAuthorization returns the key authorization of token, see rfc8555 section 8.1.
+func (c *client) keyAuthorization(token string) (string, error) {
+	tp, err := GetJWKThumbprintWithBase64url(c.account().PrivateKey.Public())
 	if err != nil {
-		return err
-	}
-	if darResp.Status != "pending" {
-		return nil
+		return "", err
 	}
-	for _, challenge := range darResp.Challenges {
-		if challenge.Type == "dns-01" {
-			var name string
-			if cname != "" {
-				name = cname
-			} else {
-				name = "_acme-challenge." + darResp.Identifier.Value
-			}
-			tp, err := GetJWKThumbprintWithBase64url(c.acct.PrivateKey.Public())
-			if err != nil {
-				return err
-			}
+	return token + "." + tp, nil
+}
 
-			keyAuthDigest := Sha256WithBase64url([]byte(challenge.Token + "." + tp))
-			dns := xdns.NewXDns(c.dns)
-			err = dns.AddDomainRecord("TXT", name, keyAuthDigest)
-			if err != nil {
-				return err
-			}
-			time.Sleep(time.Second * 10)
-			_, _, err = c.acmePost(challenge.URL, "{}")
+// waitAuthorization polls authz until it is no longer pending.
+func (c *client) waitAuthorization(ctx context.Context, authz string) error {
+	checkCount := 0
+	for {
+		checkCount++
+		darResp, resp, err := c.downloadAuthorizationResources(ctx, authz)
+		if err != nil {
+			return err
+		}
+		if darResp.Status == "pending" {
+			err = sleepContext(ctx, c.opt.retryPolicy().pollInterval(resp))
 			if err != nil {
 				return err
 			}
-
-			checkCount := 0
-			for {
-				checkCount++
-				darResp, err := c.downloadAuthorizationResources(authz)
-				if err != nil {
-					return err
-				}
-				if darResp.Status == "pending" {
-					time.Sleep(time.Second * 5)
-					if checkCount < 20 {
-						continue
-					}
-				}
-				break
-			}
-
-			err = dns.DeleteDomainRecord("TXT", name, keyAuthDigest)
-			if err != nil {
-				return err
+			if checkCount < 20 {
+				continue
 			}
-
-			break
 		}
-
+		return nil
 	}
-	return nil
 }
 
-func (c *client) getCsrUseSHA256WithRSA(sr *IdlSignReq) (string, *rsa.PrivateKey, error) {
+// getCsr returns the DER encoded csr of sr and its private key, which is
+// generated unless WithCertSigner is set.
+func (c *client) getCsr(sr *IdlSignReq) ([]byte, crypto.Signer, error) {
 
-	crt := &x509.CertificateRequest{
-		SignatureAlgorithm: x509.SHA256WithRSA,
-		Subject: pkix.Name{
-			CommonName: sr.Identifiers[0].Value,
-		},
-		DNSNames: func() []string {
-
-			var names []string
-			for _, identifier := range sr.Identifiers {
-				names = append(names, identifier.Value)
-			}
-
-			return names
-		}(),
+	var priKey crypto.Signer
+	var sigAlg x509.SignatureAlgorithm
+	var err error
+	if c.opt.certSigner != nil {
+		priKey = c.opt.certSigner
+		sigAlg, err = csrSignatureAlgorithm(priKey.Public())
+	} else {
+		priKey, sigAlg, err = generateKey(c.opt.keyType)
 	}
-	priKey, err := rsa.GenerateKey(rand.Reader, 2048)
 	if err != nil {
-		return "", nil, err
+		return nil, nil, err
 	}
 
-	csrByte, err := x509.CreateCertificateRequest(rand.Reader, crt, priKey)
-	if err != nil {
-		return "", nil, err
+	crt := &x509.CertificateRequest{
+		SignatureAlgorithm: sigAlg,
+	}
+	for _, identifier := range sr.Identifiers {
+		if identifier.Type == IdentifierTypeIP {
+			crt.IPAddresses = append(crt.IPAddresses, net.ParseIP(identifier.Value))
+			continue
+		}
+		crt.DNSNames = append(crt.DNSNames, identifier.Value)
+	}
+	// ip addresses don't go into the common name, which stays empty for ip only csrs.
+	if len(crt.DNSNames) > 0 {
+		crt.Subject.CommonName = crt.DNSNames[0]
 	}
 
-	csr := base64.RawURLEncoding.EncodeToString(csrByte)
+	csr, err := x509.CreateCertificateRequest(rand.Reader, crt, priKey)
+	if err != nil {
+		return nil, nil, err
+	}
 
 	return csr, priKey, nil
 }
 
-func (c *client) newOrder(p *IdlReqNewOrderPayload) (*IdlRespNewOrder, error) {
+// newOrder creates an order and returns it with its URL.
+func (c *client) newOrder(ctx context.Context, p *IdlReqNewOrderPayload) (*IdlRespNewOrder, string, error) {
 
-	resps, _, err := c.acmePost(c.caMeta.NewOrderURL, p)
+	resps, resp, err := c.acmePost(ctx, c.caMeta.NewOrderURL, p)
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
 
 	res := &IdlRespNewOrder{}
 
 	err = json.Unmarshal(resps, res)
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
 
-	if res.Status == "pending" || res.Status == "ready" {
-		return res, nil
+	url := resp.Header.Get("Location")
+	if url == "" {
+		return nil, "", errors.New("cupx/xacme.client.newOrder: no order URL returned")
 	}
 
-	return nil, fmt.Errorf("err New order")
+	return res, url, nil
 
 }
 
-func (c *client) downloadAuthorizationResources(url string) (*IdlRespDownLoadAuthorizationResources, error) {
+func (c *client) downloadAuthorizationResources(ctx context.Context, url string) (*IdlRespDownLoadAuthorizationResources, *http.Response, error) {
 
-	respB, _, err := c.acmePost(url, nil)
+	respB, resp, err := c.acmePost(ctx, url, nil)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	idl := &IdlRespDownLoadAuthorizationResources{}
 
 	err = json.Unmarshal(respB, idl)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	return idl, nil
+	return idl, resp, nil
+
+}
+
+// signPayload signs p with the account key.
+func (c *client) signPayload(nonce jose.NonceSource, url string, p interface{}) (string, error) {
 
+	acct := c.account()
+	return signPayloadWithKey(acct.PrivateKey, acct.AcctURL, nonce, url, p)
 }
 
-func (c *client) signPayloadWithES256(nonce jose.NonceSource, url string, p interface{}) (string, error) {
+// signPayloadWithKey signs p with key. The JWK of key is embedded if kid is empty.
+func signPayloadWithKey(key crypto.Signer, kid string, nonce jose.NonceSource, url string, p interface{}) (string, error) {
+
+	alg, err := jwsAlgorithm(key)
+	if err != nil {
+		return "", err
+	}
 
 	sk := jose.SigningKey{
-		Algorithm: jose.ES256,
-		Key:       jose.JSONWebKey{Key: c.acct.PrivateKey, KeyID: c.acct.AcctURL},
+		Algorithm: alg,
+		Key:       jose.JSONWebKey{Key: joseKey(key), KeyID: kid},
 	}
 
 	so := &jose.SignerOptions{NonceSource: nonce}
 	so.WithHeader("url", url)
 
-	if c.acct.AcctURL == "" {
+	if kid == "" {
 		so.EmbedJWK = true
 	}
 
@@ -632,17 +932,37 @@ func (c *client) signPayloadWithES256(nonce jose.NonceSource, url string, p inte
 
 }
 
-func (c *client) acmePost(url string, p interface{}) ([]byte, *http.Response, error) {
-	count := 3
-	for count != 0 {
-		jws, _ := c.signPayloadWithES256(c.nonce, url, p)
-		req, err := http.NewRequest(http.MethodPost, url, bytes.NewBuffer([]byte(jws)))
+func (c *client) acmePost(ctx context.Context, url string, p interface{}) ([]byte, *http.Response, error) {
+	return c.acmePostWithSigner(ctx, url, p, c.signPayload)
+}
+
+// acmePostWithSigner posts p signed by sign to url. Bad nonces are retried 3 times, network errors,
+// 429 and 503 are retried according to the retry policy.
+func (c *client) acmePostWithSigner(ctx context.Context, url string, p interface{},
+	sign func(nonce jose.NonceSource, url string, p interface{}) (string, error)) ([]byte, *http.Response, error) {
+	policy := c.opt.retryPolicy()
+	badNonces := 3
+	attempt := 1
+	for {
+		jws, err := sign(c.nonce.withContext(ctx), url, p)
+		if err != nil {
+			return nil, nil, err
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewBuffer([]byte(jws)))
 		if err != nil {
 			return nil, nil, err
 		}
 		req.Header.Add("Content-Type", "application/jose+json")
 		resp, err := c.httpClient.Do(req)
 		if err != nil {
+			if attempt < policy.MaxAttempts && isTransient(ctx, err) {
+				err = sleepContext(ctx, policy.backoff(attempt))
+				if err != nil {
+					return nil, nil, err
+				}
+				attempt++
+				continue
+			}
 			return nil, nil, err
 		}
 
@@ -651,28 +971,41 @@ func (c *client) acmePost(url string, p interface{}) ([]byte, *http.Response, er
 		}
 
 		respb, err := ioutil.ReadAll(resp.Body)
+		_ = resp.Body.Close()
 		if err != nil {
 			return nil, nil, err
 		}
 
-		if resp.StatusCode == http.StatusBadRequest {
+		if resp.StatusCode >= 400 {
 			respe := &IdlRespErr{}
 			_ = json.Unmarshal(respb, respe)
-			if respe.Type == "urn:ietf:params:acme:error:badNonce" {
-				count--
+			if respe.Type == "" && respe.Detail == "" {
+				respe.Detail = http.StatusText(resp.StatusCode)
+			}
+			perr := newProblemError(resp.StatusCode, respe)
+			perr.RetryAfter = retryAfter(resp, time.Now())
+			if perr.Type == acmeErrorTypes[ErrBadNonce] && badNonces > 1 {
+				badNonces--
 				continue
 			}
-		}
-
-		if resp.StatusCode >= 400 {
-			respe := &IdlRespErr{}
-			_ = json.Unmarshal(respb, respe)
-			err = errors.New("cupx/xacme.client.acmePost: " + respe.Type + " " + respe.Detail)
-			return nil, nil, err
+			if (resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable) &&
+				attempt < policy.MaxAttempts {
+				d := perr.RetryAfter
+				if d == 0 {
+					d = policy.backoff(attempt)
+				}
+				if d <= policy.MaxBackoff {
+					err = sleepContext(ctx, d)
+					if err != nil {
+						return nil, nil, err
+					}
+					attempt++
+					continue
+				}
+			}
+			return nil, nil, perr
 		}
 
 		return respb, resp, nil
 	}
-
-	return nil, nil, errors.New("cupx/xacme.client.acmePost: acmePost failed")
 }
@@ -15,11 +15,11 @@
 package xacme
 
 import (
-	"encoding/json"
+	"context"
 	"fmt"
-	"io/ioutil"
 	"log"
-	"os"
+	"net/http"
+	"net/http/httptest"
 	"testing"
 
 	"cupx.github.io/pkg/xacme/testdata"
@@ -41,9 +41,14 @@ func GetStagingAcct() Client {
 		CA:  CaLetsencryptStaging,
 		Dns: dns,
 	}
-	c := NewClient(
+	c, err := NewClient(
+		context.Background(),
 		conf,
 	)
+	if err != nil {
+		log.Println(err)
+		return nil
+	}
 	acct := new(Account)
 	acct.PemPrivateKey = data.AcmeStagingAcct.PemPrivatekey
 	acct.AcctURL = data.AcmeStagingAcct.AcctURL
@@ -64,10 +69,15 @@ func GetAcct() Client {
 		CA:  CaLetsencrypt,
 		Dns: dns,
 	}
-	c := NewClient(
+	c, err := NewClient(
+		context.Background(),
 		conf,
 		WithRootCAKeyID(CaLetsencryptRootCaKeyIdIsrgRootX1),
 	)
+	if err != nil {
+		log.Println(err)
+		return nil
+	}
 	acct := new(Account)
 	acct.PemPrivateKey = data.AcmeAcct.PemPrivatekey
 	acct.AcctURL = data.AcmeAcct.AcctURL
@@ -87,36 +97,30 @@ func TestClient_CreatAccountWithEmailStaging(t *testing.T) {
 		CA:  CaLetsencryptStaging,
 		Dns: dns,
 	}
-	c := NewClient(
+	c, err := NewClient(
+		context.Background(),
 		conf,
 	)
-
-	file, err := os.OpenFile("./testdata/acct.tmp", os.O_RDWR|os.O_CREATE, 0777)
 	if err != nil {
+		log.Println(err)
 		return
 	}
-	defer file.Close()
-
-	acctrb, err := ioutil.ReadAll(file)
 
-	acctr := &Account{}
+	s := NewFileStorage("./testdata")
 
-	json.Unmarshal(acctrb, acctr)
+	acctr, err := LoadAccount(context.Background(), s, "staging")
 
-	log.Println(acctr)
+	log.Println(acctr, err)
 
-	acct, err := c.CreateAccountWithEmail("acme@issue-tls-cert.test.xdns.cupx.net", true)
+	acct, err := c.CreateAccountWithEmail(context.Background(), "acme@issue-tls-cert.test.xdns.cupx.net", true)
 	if err != nil {
 		log.Println(acct, err)
 		return
 	}
-	acct.PrivateKey = nil
-
-	acctb, err := json.Marshal(acct)
 
-	log.Println(string(acctb), err)
+	err = StoreAccount(context.Background(), s, "staging", acct)
 
-	_, _ = file.Write(acctb)
+	log.Println(acct, err)
 
 }
 
@@ -131,21 +135,19 @@ func TestClient_SetAccountStaging(t *testing.T) {
 		CA:  CaLetsencryptStaging,
 		Dns: dns,
 	}
-	c := NewClient(
+	c, err := NewClient(
+		context.Background(),
 		conf,
 	)
-
-	file, err := os.OpenFile("./testdata/acct.tmp", os.O_RDONLY, 0777)
 	if err != nil {
+		log.Println(err)
 		return
 	}
-	defer file.Close()
-
-	acctrb, err := ioutil.ReadAll(file)
 
-	acctr := &Account{}
-
-	json.Unmarshal(acctrb, acctr)
+	acctr, err := LoadAccount(context.Background(), NewFileStorage("./testdata"), "staging")
+	if err != nil {
+		return
+	}
 
 	log.Println(acctr, err, c)
 
@@ -165,25 +167,23 @@ func TestClient_CreatAccountWithPrivateKeyStaging(t *testing.T) {
 		CA:  CaLetsencryptStaging,
 		Dns: dns,
 	}
-	c := NewClient(
+	c, err := NewClient(
+		context.Background(),
 		conf,
 	)
-
-	file, err := os.OpenFile("./testdata/acct.tmp", os.O_RDONLY, 0777)
 	if err != nil {
+		log.Println(err)
 		return
 	}
-	defer file.Close()
-
-	acctrb, err := ioutil.ReadAll(file)
-
-	acctr := &Account{}
 
-	json.Unmarshal(acctrb, acctr)
+	acctr, err := LoadAccount(context.Background(), NewFileStorage("./testdata"), "staging")
+	if err != nil {
+		return
+	}
 	acctr.AcctURL = ""
 	log.Println(acctr, err, c)
 
-	acct, err := c.CreateAccountWithPrivateKey(acctr)
+	acct, err := c.CreateAccountWithPrivateKey(context.Background(), acctr)
 
 	log.Println(acct, err)
 
@@ -207,7 +207,7 @@ func TestClient_SignCertWithDNSStaging(t *testing.T) {
 		TXTCname: "testcert2.cert.issue-tls-cert.test.xdns.cupx.net",
 	}
 
-	cert, err := c.SignCertWithDNS(idl, WithRootCAKeyID(CaLetsencryptStagingRootCaKeyIdFakeLeRootX1))
+	cert, err := c.SignCertWithDNS(context.Background(), idl, WithRootCAKeyID(CaLetsencryptStagingRootCaKeyIdFakeLeRootX1))
 	log.Println(cert, err)
 	if err != nil {
 		return
@@ -217,7 +217,7 @@ func TestClient_SignCertWithDNSStaging(t *testing.T) {
 	fmt.Println(cert.NotBefore)
 	fmt.Println(cert.NotAfter)
 
-	cert2, err := c.SignCertWithDNS(idl, WithRootCAKeyID(CaLetsencryptStagingRootCaKeyIdFakeLeRootX2))
+	cert2, err := c.SignCertWithDNS(context.Background(), idl, WithRootCAKeyID(CaLetsencryptStagingRootCaKeyIdFakeLeRootX2))
 	log.Println(cert2, err)
 	if err != nil {
 		return
@@ -246,7 +246,7 @@ func TestClient_SignCertWithDNS(t *testing.T) {
 		TXTCname: "testcert1.cert.issue-tls-cert.test.xdns.cupx.net",
 	}
 
-	cert, err := c.SignCertWithDNS(idl, WithRootCAKeyID(CaLetsencryptRootCaKeyIdDstRootCaX3))
+	cert, err := c.SignCertWithDNS(context.Background(), idl, WithRootCAKeyID(CaLetsencryptRootCaKeyIdDstRootCaX3))
 	log.Println(cert, err)
 	if err != nil {
 		return
@@ -256,7 +256,7 @@ func TestClient_SignCertWithDNS(t *testing.T) {
 	fmt.Println(cert.NotBefore)
 	fmt.Println(cert.NotAfter)
 
-	cert2, err := c.SignCertWithDNS(idl, WithRootCAKeyID(CaLetsencryptRootCaKeyIdIsrgRootX1))
+	cert2, err := c.SignCertWithDNS(context.Background(), idl, WithRootCAKeyID(CaLetsencryptRootCaKeyIdIsrgRootX1))
 	log.Println(cert2, err)
 	if err != nil {
 		return
@@ -286,7 +286,7 @@ func TestClient_SignCertWithDNSForDomain(t *testing.T) {
 		TXTCname: "testcert1.cert.issue-tls-cert.test.xdns.cupx.net",
 	}
 
-	cert, err := c.SignCertWithDNS(idl, WithRootCAKeyID(CaLetsencryptRootCaKeyIdIsrgRootX1))
+	cert, err := c.SignCertWithDNS(context.Background(), idl, WithRootCAKeyID(CaLetsencryptRootCaKeyIdIsrgRootX1))
 	log.Println(cert, err)
 	if err != nil {
 		return
@@ -297,3 +297,43 @@ func TestClient_SignCertWithDNSForDomain(t *testing.T) {
 	fmt.Println(cert.NotAfter)
 
 }
+
+func TestNewClient_DirURL(t *testing.T) {
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = fmt.Fprintf(w, `{
+			"keyChange": "%[1]s/key-change",
+			"meta": {
+				"caaIdentities": ["test.xdns.cupx.net"],
+				"termsOfService": "%[1]s/tos",
+				"website": "%[1]s",
+				"externalAccountRequired": true
+			},
+			"newAccount": "%[1]s/new-acct",
+			"newNonce": "%[1]s/new-nonce",
+			"newOrder": "%[1]s/new-order",
+			"revokeCert": "%[1]s/revoke-cert"
+		}`, srv.URL)
+	}))
+	defer srv.Close()
+
+	if _, err := NewClient(context.Background(), &Config{CA: "unknown"}); err == nil {
+		t.Error("NewClient() with unknown CA err = nil")
+	}
+
+	RegisterCA("pebble", srv.URL+"/dir")
+	for _, conf := range []*Config{{DirURL: srv.URL + "/dir"}, {CA: "pebble"}} {
+		c, err := NewClient(context.Background(), conf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dir := c.Directory()
+		if dir.NewOrder != srv.URL+"/new-order" || dir.KeyChange != srv.URL+"/key-change" {
+			t.Errorf("Directory() = %+v", dir)
+		}
+		if !dir.Meta.ExternalAccountRequired || dir.Meta.TermsOfService != srv.URL+"/tos" ||
+			dir.Meta.Website != srv.URL || len(dir.Meta.CaaIdentities) != 1 {
+			t.Errorf("Directory().Meta = %+v", dir.Meta)
+		}
+	}
+}
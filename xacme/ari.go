@@ -0,0 +1,155 @@
+// Copyright 2020 The CupX Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xacme
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"time"
+)
+
+// ErrRenewalInfoUnsupported is returned by GetRenewalInfo if the CA doesn't publish
+// acme renewal information.
+var ErrRenewalInfoUnsupported = errors.New("cupx/xacme: renewal information not supported")
+
+// defaultRenewalInfoRetryAfter is when to fetch the renewal information again if the CA
+// sends no Retry-After.
+const defaultRenewalInfoRetryAfter = time.Hour * 6
+
+// RenewalInfo is the acme renewal information (ARI) of a certificate.
+// https://datatracker.ietf.org/doc/draft-ietf-acme-ari/
+type RenewalInfo struct {
+	// WindowStart and WindowEnd bound the time the CA suggests to renew the certificate in.
+	WindowStart time.Time
+	WindowEnd   time.Time
+	// ExplanationURL explains the suggested window, e.g. of a mass revocation.
+	ExplanationURL string
+	// RetryAfter is when to fetch the renewal information again.
+	RetryAfter time.Duration
+}
+
+// RenewalTime returns a random time in the suggested window.
+func (ri *RenewalInfo) RenewalTime() time.Time {
+	window := ri.WindowEnd.Sub(ri.WindowStart)
+	if window <= 0 {
+		return ri.WindowStart
+	}
+	return ri.WindowStart.Add(time.Duration(rand.Int63n(int64(window))))
+}
+
+// WithReplaces sets the replaces field of new orders to the ARI certificate ID of the
+// certificate being renewed, see ARICertID.
+func WithReplaces(certID string) Option {
+	return func(opt *option) {
+		opt.replaces = certID
+	}
+}
+
+// ARICertID returns the ARI certificate ID of the pem encoded certificate, the base64url
+// encoded key identifier of its authority key identifier and its serial number joined by a dot.
+func ARICertID(certPEM string) (string, error) {
+	cert, err := parsePemCertificate(certPEM)
+	if err != nil {
+		return "", err
+	}
+	return ariCertID(cert)
+}
+
+func ariCertID(cert *x509.Certificate) (string, error) {
+	if len(cert.AuthorityKeyId) == 0 {
+		return "", errors.New("cupx/xacme: certificate has no authority key identifier")
+	}
+	// the serial is the content of its DER encoding, with a leading zero if the high bit is set.
+	serial := cert.SerialNumber.Bytes()
+	if len(serial) == 0 || serial[0]&0x80 != 0 {
+		serial = append([]byte{0}, serial...)
+	}
+	return base64.RawURLEncoding.EncodeToString(cert.AuthorityKeyId) + "." +
+		base64.RawURLEncoding.EncodeToString(serial), nil
+}
+
+func (c *client) GetRenewalInfo(ctx context.Context, certPEM string) (*RenewalInfo, error) {
+
+	if c.caMeta.RenewalInfoURL == "" {
+		return nil, ErrRenewalInfoUnsupported
+	}
+	certID, err := ARICertID(certPEM)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.caMeta.RenewalInfoURL+"/"+certID, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	respb, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 400 {
+		respe := &IdlRespErr{}
+		_ = json.Unmarshal(respb, respe)
+		if respe.Type == "" && respe.Detail == "" {
+			respe.Detail = http.StatusText(resp.StatusCode)
+		}
+		perr := newProblemError(resp.StatusCode, respe)
+		perr.RetryAfter = retryAfter(resp, time.Now())
+		return nil, perr
+	}
+
+	idl := &IdlRespRenewalInfo{}
+	err = json.Unmarshal(respb, idl)
+	if err != nil {
+		return nil, err
+	}
+	if idl.SuggestedWindow.Start.IsZero() || idl.SuggestedWindow.End.Before(idl.SuggestedWindow.Start) {
+		return nil, fmt.Errorf("cupx/xacme.client.GetRenewalInfo: invalid suggested window %v - %v",
+			idl.SuggestedWindow.Start, idl.SuggestedWindow.End)
+	}
+
+	ri := &RenewalInfo{
+		WindowStart:    idl.SuggestedWindow.Start,
+		WindowEnd:      idl.SuggestedWindow.End,
+		ExplanationURL: idl.ExplanationURL,
+		RetryAfter:     retryAfter(resp, time.Now()),
+	}
+	if ri.RetryAfter == 0 {
+		ri.RetryAfter = defaultRenewalInfoRetryAfter
+	}
+	return ri, nil
+}
+
+// parsePemCertificate parses the first certificate of certPEM.
+func parsePemCertificate(certPEM string) (*x509.Certificate, error) {
+	block, _ := pem.Decode([]byte(certPEM))
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, errors.New("cupx/xacme: no certificate found")
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
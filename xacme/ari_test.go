@@ -0,0 +1,187 @@
+// Copyright 2020 The CupX Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xacme
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestARICertID(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the example of the acme renewal information draft.
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(0x87654321),
+		AuthorityKeyId: []byte{0x69, 0x88, 0x5B, 0x6B, 0x87, 0x46, 0x40, 0x41, 0xE1, 0xB3,
+			0x7B, 0x84, 0x7B, 0xA0, 0xAE, 0x2C, 0xDE, 0x01, 0xC8, 0xD4},
+		NotBefore: time.Now(),
+		NotAfter:  time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certID, err := ARICertID(string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "aYhba4dGQEHhs3uEe6CuLN4ByNQ.AIdlQyE"; certID != want {
+		t.Errorf("ARICertID() = %v, want %v", certID, want)
+	}
+
+	if _, err := ARICertID("not a certificate"); err == nil {
+		t.Error("ARICertID() without certificate err = nil")
+	}
+}
+
+// fakeRenewalInfo serves the renewal information of the fake CA.
+type fakeRenewalInfo struct {
+	mu         sync.Mutex
+	start, end time.Time
+	retryAfter string
+	certIDs    chan string
+}
+
+func (ri *fakeRenewalInfo) set(start, end time.Time, retryAfter string) {
+	ri.mu.Lock()
+	defer ri.mu.Unlock()
+	ri.start, ri.end, ri.retryAfter = start, end, retryAfter
+}
+
+func (ri *fakeRenewalInfo) serve(w http.ResponseWriter, certID string) {
+	ri.mu.Lock()
+	defer ri.mu.Unlock()
+	if ri.retryAfter != "" {
+		w.Header().Set("Retry-After", ri.retryAfter)
+	}
+	_, _ = fmt.Fprintf(w, `{"suggestedWindow":{"start":%q,"end":%q},"explanationURL":"https://ca.example/why"}`,
+		ri.start.Format(time.RFC3339), ri.end.Format(time.RFC3339))
+	ri.certIDs <- certID
+}
+
+func TestClient_GetRenewalInfo(t *testing.T) {
+	ca := newFakeCA(t)
+	ca.enableOrders()
+	ri := &fakeRenewalInfo{certIDs: make(chan string, 1)}
+	ca.renewalInfo = ri.serve
+	c := ca.newClient(WithSolver(ChallengeTypeDNS01, &recordSolver{}))
+
+	cert, err := c.SignCert(context.Background(), &IdlSignReq{Identifiers: []IdlIdentifier{{Type: "dns", Value: "ari.test.xdns.cupx.net"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now().Add(24 * time.Hour).UTC().Truncate(time.Second)
+	ri.set(start, start.Add(time.Hour), "120")
+
+	info, err := c.GetRenewalInfo(context.Background(), cert.PemCertBody)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certID, _ := ARICertID(cert.PemCertBody)
+	if got := <-ri.certIDs; got != certID {
+		t.Errorf("renewal info of %v, want %v", got, certID)
+	}
+	if !info.WindowStart.Equal(start) || !info.WindowEnd.Equal(start.Add(time.Hour)) ||
+		info.RetryAfter != 2*time.Minute || info.ExplanationURL != "https://ca.example/why" {
+		t.Errorf("GetRenewalInfo() = %+v", info)
+	}
+	if at := info.RenewalTime(); at.Before(info.WindowStart) || at.After(info.WindowEnd) {
+		t.Errorf("RenewalTime() = %v, not in the window", at)
+	}
+
+	ca2 := newFakeCA(t)
+	c2 := ca2.newClient()
+	if _, err := c2.GetRenewalInfo(context.Background(), cert.PemCertBody); !errors.Is(err, ErrRenewalInfoUnsupported) {
+		t.Errorf("GetRenewalInfo() err = %v, want %v", err, ErrRenewalInfoUnsupported)
+	}
+}
+
+func TestManager_RenewalInfo(t *testing.T) {
+	ca := newFakeCA(t)
+	fo := ca.enableOrders()
+	ri := &fakeRenewalInfo{certIDs: make(chan string, 4)}
+	ca.renewalInfo = ri.serve
+	c := ca.newClient(WithSolver(ChallengeTypeDNS01, &recordSolver{}))
+
+	sr := &IdlSignReq{Identifiers: []IdlIdentifier{{Type: "dns", Value: "ari.test.xdns.cupx.net"}}}
+	cert, err := c.SignCert(context.Background(), sr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certID, _ := ARICertID(cert.PemCertBody)
+
+	clock := newFakeClock()
+	renewed := make(chan *CertInfo, 1)
+	m := NewManager(c)
+	m.Clock = clock
+	m.OnRenewed = func(name string, cert *CertInfo) {
+		renewed <- cert
+	}
+	// the window is far before the renewal time of the lifetime.
+	start := clock.Now().Add(10 * 24 * time.Hour).UTC().Truncate(time.Second)
+	ri.set(start, start.Add(time.Hour), "3600")
+	if err := m.Manage("ari", sr, cert); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		_ = m.Run(ctx)
+	}()
+
+	// the renewal information is checked at once and the renewal moves into the window.
+	<-ri.certIDs
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		renewAt, _ := m.RenewalTime("ari")
+		if !renewAt.Before(start) && !renewAt.After(start.Add(time.Hour)) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("RenewalTime() = %v, not in the suggested window", renewAt)
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// it is checked again after Retry-After and the certificate is renewed at once
+	// if the CA moves the window into the past.
+	ri.set(clock.Now().Add(-time.Hour), clock.Now(), "")
+	clock.AdvanceTo(clock.Now().Add(time.Hour))
+	if got := <-ri.certIDs; got != certID {
+		t.Errorf("renewal info of %v, want %v", got, certID)
+	}
+	<-renewed
+	fo.ca.mu.Lock()
+	replaces := fo.Replaces[len(fo.Replaces)-1]
+	fo.ca.mu.Unlock()
+	if replaces != certID {
+		t.Errorf("replaces = %q, want %q", replaces, certID)
+	}
+}
@@ -0,0 +1,56 @@
+// Copyright 2020 The CupX Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xacme
+
+import "sync"
+
+const (
+	CaZeroSSL            = "zerossl"
+	CaBuypass            = "buypass"
+	CaBuypassStaging     = "buypass_staging"
+	CaGoogleTrust        = "google_trust"
+	CaGoogleTrustStaging = "google_trust_staging"
+)
+
+var (
+	caAcmeDirMu  sync.RWMutex
+	caAcmeDirMap = map[string]string{
+		CaLetsencrypt:        "https://acme-v02.api.letsencrypt.org/directory",
+		CaLetsencryptStaging: "https://acme-staging-v02.api.letsencrypt.org/directory",
+		CaZeroSSL:            "https://acme.zerossl.com/v2/DV90",
+		CaBuypass:            "https://api.buypass.com/acme/directory",
+		CaBuypassStaging:     "https://api.test4.buypass.no/acme/directory",
+		CaGoogleTrust:        "https://dv.acme-v02.api.pki.goog/directory",
+		CaGoogleTrustStaging: "https://dv.acme-v02.test-api.pki.goog/directory",
+	}
+)
+
+// RegisterCA registers the directory URL of a named CA, so that it can be used as Config.CA.
+// Registering an existing name replaces its directory URL.
+func RegisterCA(name string, dirURL string) {
+	caAcmeDirMu.Lock()
+	defer caAcmeDirMu.Unlock()
+
+	caAcmeDirMap[name] = dirURL
+}
+
+// LookupCA returns the directory URL of a named CA.
+func LookupCA(name string) (string, bool) {
+	caAcmeDirMu.RLock()
+	defer caAcmeDirMu.RUnlock()
+
+	d, ok := caAcmeDirMap[name]
+	return d, ok
+}
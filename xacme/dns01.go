@@ -0,0 +1,271 @@
+// Copyright 2020 The CupX Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xacme
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"cupx.github.io/pkg/xdns"
+)
+
+// ErrNoDNSProvider is returned when no dns provider is configured for the TXT record of an identifier.
+var ErrNoDNSProvider = errors.New("cupx/xacme: no dns provider")
+
+// challengeLabel is the label of dns-01 TXT records, see rfc8555 section 8.4.
+const challengeLabel = "_acme-challenge"
+
+// DNSSolver solves dns-01 challenges with xdns.
+type DNSSolver struct {
+	// DNS creates and deletes the TXT records unless Providers or ProviderFunc choose another provider.
+	DNS xdns.XDns
+	// Providers maps zones to the providers hosting them, the longest zone the TXT record name
+	// is in wins over shorter ones and over DNS.
+	Providers map[string]xdns.XDns
+	// ProviderFunc returns the provider of the TXT record name of identifier, it takes precedence
+	// over Providers and DNS. A nil provider falls back to them.
+	ProviderFunc func(identifier string, recordName string) (xdns.XDns, error)
+	// TXTCname overrides the TXT record name of every identifier if it is not empty.
+	TXTCname string
+	// TXTCnames maps identifiers to TXT record names, e.g. to delegate _acme-challenge.example.com
+	// to example.com.validation.example.net. It takes precedence over TXTCname and FollowCNAME.
+	// The entry of an identifier takes precedence over the entry of its wildcard.
+	TXTCnames map[string]string
+	// FollowCNAME writes the TXT record at the end of the CNAME chain of _acme-challenge.<identifier>,
+	// so that write access to the validation zone is enough.
+	FollowCNAME bool
+	// Resolvers are the "host:port" addresses of the resolvers following the CNAME chains,
+	// the system resolver is used if it is empty.
+	Resolvers []string
+	// Propagation checks that the TXT record is served by the authoritative nameservers
+	// before the CA is told to validate, it is skipped if nil.
+	Propagation *PropagationChecker
+	// PropagationWait is how long to wait after the TXT record is created, or after it has
+	// propagated if Propagation is set. It defaults to 10 seconds if Propagation is nil.
+	PropagationWait time.Duration
+
+	mu sync.Mutex
+	// records are the TXT records of the presented challenges by token.
+	records map[string]dnsRecord
+	// refs counts the presented challenges by TXT record name. Challenges sharing a name,
+	// e.g. of example.com and *.example.com, keep all values until the last is cleaned up.
+	refs map[string]int
+	// released are the records of the cleaned up challenges waiting for the last challenge of their name.
+	released map[string][]dnsRecord
+}
+
+// dnsRecord is a TXT record created by Present.
+type dnsRecord struct {
+	name  string
+	value string
+	dns   xdns.XDns
+}
+
+// key returns the key of the record name in refs and released.
+func (r dnsRecord) key() string {
+	return strings.ToLower(toFqdn(r.name))
+}
+
+// NewDNSSolver returns DNSSolver following CNAME chains and checking the propagation of the
+// TXT records with the default PropagationChecker.
+func NewDNSSolver(dns xdns.XDns, cname string) *DNSSolver {
+	return &DNSSolver{
+		DNS:         dns,
+		TXTCname:    cname,
+		FollowCNAME: true,
+		Propagation: &PropagationChecker{},
+	}
+}
+
+// RecordName returns the TXT record name of ch without following CNAME chains.
+func (s *DNSSolver) RecordName(ch *Challenge) string {
+	// the exact identifier takes precedence over the wildcard one, which shares its name.
+	for _, key := range []string{ch.Identifier.Value, "*." + ch.Identifier.Value} {
+		for k, v := range s.TXTCnames {
+			if strings.EqualFold(k, key) {
+				return v
+			}
+		}
+	}
+	if s.TXTCname != "" {
+		return s.TXTCname
+	}
+	return challengeLabel + "." + ch.Identifier.Value
+}
+
+// ResolveRecordName returns the TXT record name of ch, following the CNAME chain of
+// _acme-challenge.<identifier> if FollowCNAME is set and no explicit name is configured.
+func (s *DNSSolver) ResolveRecordName(ctx context.Context, ch *Challenge) (string, error) {
+	name := s.RecordName(ch)
+	if !s.FollowCNAME || name != challengeLabel+"."+ch.Identifier.Value {
+		return name, nil
+	}
+	return followCNAME(ctx, newResolver(s.Resolvers), name)
+}
+
+// RecordValue returns the TXT record value of ch.
+func (s *DNSSolver) RecordValue(ch *Challenge) string {
+	return Sha256WithBase64url([]byte(ch.KeyAuthorization))
+}
+
+// Provider returns the provider of the TXT record name of identifier.
+func (s *DNSSolver) Provider(identifier string, name string) (xdns.XDns, error) {
+	if s.ProviderFunc != nil {
+		dns, err := s.ProviderFunc(identifier, name)
+		if err != nil {
+			return nil, err
+		}
+		if dns != nil {
+			return dns, nil
+		}
+	}
+
+	fqdn := strings.ToLower(toFqdn(name))
+	var dns xdns.XDns
+	zoneLen := 0
+	for zone, p := range s.Providers {
+		zone = strings.ToLower(toFqdn(zone))
+		if (fqdn == zone || strings.HasSuffix(fqdn, "."+zone)) && len(zone) > zoneLen {
+			dns, zoneLen = p, len(zone)
+		}
+	}
+	if dns == nil {
+		dns = s.DNS
+	}
+	if dns == nil {
+		return nil, fmt.Errorf("%w for %s, TXT record %s", ErrNoDNSProvider, identifier, name)
+	}
+	return dns, nil
+}
+
+func (s *DNSSolver) Present(ctx context.Context, ch *Challenge) error {
+	if ch.Identifier.Type == IdentifierTypeIP {
+		return fmt.Errorf("%w: %s", ErrIPIdentifierDNS01, ch.Identifier.Value)
+	}
+	name, err := s.ResolveRecordName(ctx, ch)
+	if err != nil {
+		return err
+	}
+	dns, err := s.Provider(ch.Identifier.Value, name)
+	if err != nil {
+		return err
+	}
+
+	r := dnsRecord{name: name, value: s.RecordValue(ch), dns: dns}
+	if err := dns.AddDomainRecord("TXT", r.name, r.value); err != nil {
+		return err
+	}
+
+	// records are deleted by value, so a record added while another challenge at the same
+	// name is cleaned up is not deleted with it.
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.records == nil {
+		s.records = make(map[string]dnsRecord)
+		s.refs = make(map[string]int)
+		s.released = make(map[string][]dnsRecord)
+	}
+	s.records[ch.Token] = r
+	s.refs[r.key()]++
+	return nil
+}
+
+func (s *DNSSolver) Wait(ctx context.Context, ch *Challenge) error {
+	d := s.PropagationWait
+	if s.Propagation != nil {
+		err := s.Propagation.Wait(ctx, s.presented(ch).name, s.RecordValue(ch))
+		if err != nil {
+			return err
+		}
+	} else if d == 0 {
+		d = time.Second * 10
+	}
+	if d == 0 {
+		return nil
+	}
+	return sleepContext(ctx, d)
+}
+
+// CleanUp deletes the TXT record of ch, or keeps it until the last challenge presented at the
+// same name is cleaned up and then deletes all of their records.
+func (s *DNSSolver) CleanUp(ctx context.Context, ch *Challenge) error {
+	s.mu.Lock()
+	r, ok := s.records[ch.Token]
+	if !ok {
+		// not presented, or Present failed to create the record.
+		s.mu.Unlock()
+		return nil
+	}
+	delete(s.records, ch.Token)
+	key := r.key()
+	s.refs[key]--
+	if s.refs[key] > 0 {
+		s.released[key] = append(s.released[key], r)
+		s.mu.Unlock()
+		return nil
+	}
+	rs := append(s.released[key], r)
+	delete(s.refs, key)
+	delete(s.released, key)
+	s.mu.Unlock()
+
+	var errs []error
+	for _, r := range rs {
+		if err := r.dns.DeleteDomainRecord("TXT", r.name, r.value); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return joinErrors(errs...)
+}
+
+// presented returns the TXT record ch was presented at.
+func (s *DNSSolver) presented(ch *Challenge) dnsRecord {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if r, ok := s.records[ch.Token]; ok {
+		return r
+	}
+	return dnsRecord{name: s.RecordName(ch)}
+}
+
+// maxCNAMEHops bounds the length of a CNAME chain.
+const maxCNAMEHops = 10
+
+// followCNAME returns the end of the CNAME chain of name, or name if it has no CNAME.
+func followCNAME(ctx context.Context, r *net.Resolver, name string) (string, error) {
+	fqdn := toFqdn(name)
+	for i := 0; i < maxCNAMEHops; i++ {
+		qctx, cancel := context.WithTimeout(ctx, queryTimeout)
+		cname, err := r.LookupCNAME(qctx, fqdn)
+		cancel()
+		if err != nil {
+			var derr *net.DNSError
+			if errors.As(err, &derr) && derr.IsNotFound {
+				break
+			}
+			return "", err
+		}
+		if cname == "" || strings.EqualFold(toFqdn(cname), fqdn) {
+			break
+		}
+		fqdn = toFqdn(cname)
+	}
+	return strings.TrimSuffix(fqdn, "."), nil
+}
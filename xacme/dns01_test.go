@@ -0,0 +1,288 @@
+// Copyright 2020 The CupX Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xacme
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+
+	"cupx.github.io/pkg/xdns"
+)
+
+// fakeXDns creates the records in fakeDNS.
+type fakeXDns struct {
+	dns     *fakeDNS
+	mu      sync.Mutex
+	adds    int
+	deletes int
+	addErr  error
+}
+
+func (x *fakeXDns) AddDomainRecord(t string, name string, value string) error {
+	x.mu.Lock()
+	x.adds++
+	x.mu.Unlock()
+	if x.addErr != nil {
+		return x.addErr
+	}
+	x.dns.add(name, dnsTypeTXT, value)
+	return nil
+}
+
+func (x *fakeXDns) DeleteDomainRecord(t string, name string, value string) error {
+	x.mu.Lock()
+	x.deletes++
+	x.mu.Unlock()
+	x.dns.remove(name, dnsTypeTXT, value)
+	return nil
+}
+
+func (x *fakeXDns) DnsDeleteDomainRecordByID(id string) error {
+	return nil
+}
+
+func TestDNSSolver(t *testing.T) {
+	d := newFakeDNS(t)
+	d.zone("test.xdns.cupx.net")
+	ca := newFakeCA(t)
+	fo := ca.enableOrders()
+	fo.Validate = func(authz *fakeAuthz, ch *fakeChallenge) bool {
+		// the record must be served when the CA is told to validate.
+		return containsString(d.txt("_acme-challenge."+authz.Identifier.Value), Sha256WithBase64url([]byte(ch.KeyAuth)))
+	}
+
+	x := &fakeXDns{dns: d}
+	s := NewDNSSolver(x, "")
+	s.Resolvers = []string{d.addr()}
+	s.Propagation = d.checker()
+	c := ca.newClient(WithSolver(ChallengeTypeDNS01, s))
+
+	sr := &IdlSignReq{Identifiers: []IdlIdentifier{
+		{Type: "dns", Value: "dns01.test.xdns.cupx.net"},
+		{Type: "dns", Value: "www.dns01.test.xdns.cupx.net"},
+	}}
+	if _, err := c.SignCert(context.Background(), sr); err != nil {
+		t.Fatal(err)
+	}
+	if x.adds != 2 || x.deletes != 2 {
+		t.Errorf("adds = %d, deletes = %d", x.adds, x.deletes)
+	}
+	if txt := d.txt("_acme-challenge.dns01.test.xdns.cupx.net"); len(txt) != 0 {
+		t.Errorf("TXT records left: %v", txt)
+	}
+}
+
+func TestDNSSolver_FollowCNAME(t *testing.T) {
+	d := newFakeDNS(t)
+	d.zone("test.xdns.cupx.net")
+	d.zone("validation.test.xdns.cupx.net")
+	d.add("_acme-challenge.a.test.xdns.cupx.net", dnsTypeCNAME, "a.validation.test.xdns.cupx.net")
+	d.add("_acme-challenge.b.test.xdns.cupx.net", dnsTypeCNAME, "hop.test.xdns.cupx.net")
+	d.add("hop.test.xdns.cupx.net", dnsTypeCNAME, "b.validation.test.xdns.cupx.net")
+	want := map[string]string{
+		"a.test.xdns.cupx.net": "a.validation.test.xdns.cupx.net",
+		"b.test.xdns.cupx.net": "b.validation.test.xdns.cupx.net",
+		"c.test.xdns.cupx.net": "_acme-challenge.c.test.xdns.cupx.net",
+		"d.test.xdns.cupx.net": "mapped.validation.test.xdns.cupx.net",
+	}
+
+	ca := newFakeCA(t)
+	fo := ca.enableOrders()
+	fo.Validate = func(authz *fakeAuthz, ch *fakeChallenge) bool {
+		return containsString(d.txt(want[authz.Identifier.Value]), Sha256WithBase64url([]byte(ch.KeyAuth)))
+	}
+
+	x := &fakeXDns{dns: d}
+	s := NewDNSSolver(x, "")
+	s.Resolvers = []string{d.addr()}
+	s.Propagation = d.checker()
+	s.TXTCnames = map[string]string{"d.test.xdns.cupx.net": "mapped.validation.test.xdns.cupx.net"}
+	c := ca.newClient(WithSolver(ChallengeTypeDNS01, s))
+
+	sr := &IdlSignReq{}
+	for identifier := range want {
+		sr.Identifiers = append(sr.Identifiers, IdlIdentifier{Type: "dns", Value: identifier})
+	}
+	if _, err := c.SignCert(context.Background(), sr); err != nil {
+		t.Fatal(err)
+	}
+	if x.adds != 4 || x.deletes != 4 {
+		t.Errorf("adds = %d, deletes = %d", x.adds, x.deletes)
+	}
+	for _, name := range want {
+		if txt := d.txt(name); len(txt) != 0 {
+			t.Errorf("TXT records left at %s: %v", name, txt)
+		}
+	}
+
+	s.FollowCNAME = false
+	ch := &Challenge{Identifier: IdlIdentifier{Type: "dns", Value: "a.test.xdns.cupx.net"}}
+	if name, _ := s.ResolveRecordName(context.Background(), ch); name != "_acme-challenge.a.test.xdns.cupx.net" {
+		t.Errorf("ResolveRecordName() without FollowCNAME = %v", name)
+	}
+}
+
+func TestDNSSolver_Provider(t *testing.T) {
+	d := newFakeDNS(t)
+	d.zone("test.xdns.cupx.net")
+	d.zone("other.xdns.cupx.net")
+	d.add("_acme-challenge.delegated.other.xdns.cupx.net", dnsTypeCNAME, "delegated.sub.test.xdns.cupx.net")
+	ali, sub, other := &fakeXDns{dns: d}, &fakeXDns{dns: d}, &fakeXDns{dns: d}
+
+	ca := newFakeCA(t)
+	ca.enableOrders()
+	s := NewDNSSolver(nil, "")
+	s.Resolvers = []string{d.addr()}
+	s.Propagation = d.checker()
+	s.Providers = map[string]xdns.XDns{
+		"test.xdns.cupx.net":      ali,
+		"sub.test.xdns.cupx.net.": sub,
+	}
+	s.ProviderFunc = func(identifier string, recordName string) (xdns.XDns, error) {
+		if identifier == "func.other.xdns.cupx.net" {
+			return other, nil
+		}
+		return nil, nil
+	}
+	c := ca.newClient(WithSolver(ChallengeTypeDNS01, s))
+
+	sr := &IdlSignReq{Identifiers: []IdlIdentifier{
+		{Type: "dns", Value: "test.xdns.cupx.net"},
+		{Type: "dns", Value: "a.sub.test.xdns.cupx.net"},
+		{Type: "dns", Value: "b.sub.test.xdns.cupx.net"},
+		// the record of a delegated identifier is routed by its CNAME target.
+		{Type: "dns", Value: "delegated.other.xdns.cupx.net"},
+		{Type: "dns", Value: "func.other.xdns.cupx.net"},
+	}}
+	if _, err := c.SignCert(context.Background(), sr); err != nil {
+		t.Fatal(err)
+	}
+	if ali.adds != 1 || sub.adds != 3 || other.adds != 1 {
+		t.Errorf("adds = %d, %d, %d, want 1, 3, 1", ali.adds, sub.adds, other.adds)
+	}
+	if ali.deletes != 1 || sub.deletes != 3 || other.deletes != 1 {
+		t.Errorf("deletes = %d, %d, %d, want 1, 3, 1", ali.deletes, sub.deletes, other.deletes)
+	}
+
+	sr = &IdlSignReq{Identifiers: []IdlIdentifier{{Type: "dns", Value: "missing.other.xdns.cupx.net"}}}
+	_, err := c.SignCert(context.Background(), sr)
+	if !errors.Is(err, ErrNoDNSProvider) || !strings.Contains(err.Error(), "missing.other.xdns.cupx.net") {
+		t.Errorf("SignCert() err = %v, want %v naming the identifier", err, ErrNoDNSProvider)
+	}
+}
+
+func TestDNSSolver_SharedName(t *testing.T) {
+	d := newFakeDNS(t)
+	d.zone("test.xdns.cupx.net")
+	ca := newFakeCA(t)
+	fo := ca.enableOrders()
+	fo.Validate = func(authz *fakeAuthz, ch *fakeChallenge) bool {
+		// the values of example.com and *.example.com must coexist until both are validated.
+		txt := d.txt("_acme-challenge.shared.test.xdns.cupx.net")
+		return len(txt) == 2 && containsString(txt, Sha256WithBase64url([]byte(ch.KeyAuth)))
+	}
+
+	x := &fakeXDns{dns: d}
+	s := NewDNSSolver(x, "")
+	s.Resolvers = []string{d.addr()}
+	s.Propagation = d.checker()
+	c := ca.newClient(WithSolver(ChallengeTypeDNS01, s))
+
+	sr := &IdlSignReq{Identifiers: []IdlIdentifier{
+		{Type: "dns", Value: "shared.test.xdns.cupx.net"},
+		{Type: "dns", Value: "*.shared.test.xdns.cupx.net"},
+	}}
+	if _, err := c.SignCert(context.Background(), sr); err != nil {
+		t.Fatal(err)
+	}
+	if x.adds != 2 || x.deletes != 2 {
+		t.Errorf("adds = %d, deletes = %d", x.adds, x.deletes)
+	}
+	if txt := d.txt("_acme-challenge.shared.test.xdns.cupx.net"); len(txt) != 0 {
+		t.Errorf("TXT records left: %v", txt)
+	}
+
+	// challenges sharing a name are deleted with the last cleanup.
+	ctx := context.Background()
+	apex := &Challenge{Token: "apex", Identifier: IdlIdentifier{Type: "dns", Value: "shared.test.xdns.cupx.net"}, KeyAuthorization: "apex.ka"}
+	wildcard := &Challenge{Token: "wildcard", Identifier: apex.Identifier, KeyAuthorization: "wildcard.ka"}
+	for _, ch := range []*Challenge{apex, wildcard} {
+		if err := s.Present(ctx, ch); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.CleanUp(ctx, apex); err != nil {
+		t.Fatal(err)
+	}
+	if txt := d.txt("_acme-challenge.shared.test.xdns.cupx.net"); len(txt) != 2 {
+		t.Errorf("TXT records after the first cleanup = %v, want 2", txt)
+	}
+	if err := s.CleanUp(ctx, wildcard); err != nil {
+		t.Fatal(err)
+	}
+	if txt := d.txt("_acme-challenge.shared.test.xdns.cupx.net"); len(txt) != 0 {
+		t.Errorf("TXT records left: %v", txt)
+	}
+}
+
+func TestDNSSolver_PresentError(t *testing.T) {
+	d := newFakeDNS(t)
+	d.zone("test.xdns.cupx.net")
+	errAdd := errors.New("add failed")
+	x := &fakeXDns{dns: d, addErr: errAdd}
+	s := NewDNSSolver(x, "")
+
+	// a record failing to be created is not deleted by the cleanup.
+	ctx := context.Background()
+	ch := &Challenge{Token: "token", Identifier: IdlIdentifier{Type: "dns", Value: "fail.test.xdns.cupx.net"}, KeyAuthorization: "token.ka"}
+	if err := s.Present(ctx, ch); !errors.Is(err, errAdd) {
+		t.Errorf("Present() err = %v, want %v", err, errAdd)
+	}
+	if err := s.CleanUp(ctx, ch); err != nil {
+		t.Errorf("CleanUp() err = %v", err)
+	}
+	if x.deletes != 0 {
+		t.Errorf("deletes = %d, want 0", x.deletes)
+	}
+}
+
+func TestDNSSolver_RecordName(t *testing.T) {
+	s := NewDNSSolver(nil, "")
+	s.TXTCnames = map[string]string{
+		"example.com":       "apex.validation.example.net",
+		"*.Example.com":     "wildcard.validation.example.net",
+		"*.api.example.com": "api.validation.example.net",
+	}
+	tests := []struct {
+		identifier string
+		want       string
+	}{
+		{"example.com", "apex.validation.example.net"},
+		{"api.example.com", "api.validation.example.net"},
+		{"www.example.com", "_acme-challenge.www.example.com"},
+	}
+	for _, tt := range tests {
+		ch := &Challenge{Identifier: IdlIdentifier{Type: "dns", Value: tt.identifier}}
+		// the map is iterated in random order, the name must not depend on it.
+		for i := 0; i < 20; i++ {
+			if got := s.RecordName(ch); got != tt.want {
+				t.Fatalf("RecordName(%s) = %v, want %v", tt.identifier, got, tt.want)
+			}
+		}
+	}
+}
@@ -0,0 +1,100 @@
+// Copyright 2020 The CupX Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xacme
+
+import (
+	"crypto"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+
+	"gopkg.in/square/go-jose.v2"
+)
+
+const (
+	EABAlgHS256 = "HS256"
+	EABAlgHS384 = "HS384"
+	EABAlgHS512 = "HS512"
+)
+
+// ExternalAccountBinding binds a new acme account to an account of the CA, see rfc8555 section 7.3.4.
+type ExternalAccountBinding struct {
+	// KeyID is the key identifier provided by the CA.
+	KeyID string
+	// HMACKey is the base64url encoded MAC key provided by the CA.
+	HMACKey string
+	// Algorithm is one of EABAlgHS256, EABAlgHS384 and EABAlgHS512. It defaults to EABAlgHS256.
+	Algorithm string
+}
+
+// WithExternalAccountBinding sets the external account binding used when creating the account.
+func WithExternalAccountBinding(keyID string, hmacKey string, alg string) Option {
+	return func(opt *option) {
+		opt.eab = &ExternalAccountBinding{
+			KeyID:     keyID,
+			HMACKey:   hmacKey,
+			Algorithm: alg,
+		}
+	}
+}
+
+// signEAB returns the externalAccountBinding JWS which signs pub, the public key of the account,
+// with the MAC key.
+func signEAB(eab *ExternalAccountBinding, pub crypto.PublicKey, url string) (json.RawMessage, error) {
+
+	var alg jose.SignatureAlgorithm
+	switch eab.Algorithm {
+	case "", EABAlgHS256:
+		alg = jose.HS256
+	case EABAlgHS384:
+		alg = jose.HS384
+	case EABAlgHS512:
+		alg = jose.HS512
+	default:
+		return nil, errors.New("cupx/xacme: unsupported eab algorithm " + eab.Algorithm)
+	}
+
+	key, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(eab.HMACKey, "="))
+	if err != nil {
+		return nil, err
+	}
+
+	sk := jose.SigningKey{
+		Algorithm: alg,
+		Key:       key,
+	}
+
+	so := &jose.SignerOptions{}
+	so.WithHeader("kid", eab.KeyID)
+	so.WithHeader("url", url)
+
+	s, err := jose.NewSigner(sk, so)
+	if err != nil {
+		return nil, err
+	}
+
+	jwk, err := json.Marshal(jose.JSONWebKey{Key: joseKey(pub)})
+	if err != nil {
+		return nil, err
+	}
+
+	jws, err := s.Sign(jwk)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.RawMessage(jws.FullSerialize()), nil
+}
@@ -0,0 +1,100 @@
+// Copyright 2020 The CupX Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xacme
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"testing"
+
+	"gopkg.in/square/go-jose.v2"
+)
+
+func TestSignEAB(t *testing.T) {
+	priKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hmacKey := []byte("0123456789abcdef0123456789abcdef")
+
+	for _, alg := range []string{"", EABAlgHS256, EABAlgHS384, EABAlgHS512} {
+		t.Run(alg, func(t *testing.T) {
+			eab := &ExternalAccountBinding{
+				KeyID:     "kid-1",
+				HMACKey:   base64.RawURLEncoding.EncodeToString(hmacKey),
+				Algorithm: alg,
+			}
+			raw, err := signEAB(eab, priKey.Public(), "https://ca.test.xdns.cupx.net/new-acct")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			jws, err := jose.ParseSigned(string(raw))
+			if err != nil {
+				t.Fatal(err)
+			}
+			h := jws.Signatures[0].Protected
+			if h.KeyID != "kid-1" || h.ExtraHeaders["url"] != "https://ca.test.xdns.cupx.net/new-acct" {
+				t.Errorf("protected header = %+v", h)
+			}
+			if alg != "" && h.Algorithm != alg {
+				t.Errorf("alg = %v, want %v", h.Algorithm, alg)
+			}
+
+			payload, err := jws.Verify(hmacKey)
+			if err != nil {
+				t.Fatal(err)
+			}
+			jwk := jose.JSONWebKey{}
+			if err := jwk.UnmarshalJSON(payload); err != nil {
+				t.Fatal(err)
+			}
+			if pub, ok := jwk.Key.(*ecdsa.PublicKey); !ok || pub.X.Cmp(priKey.X) != 0 {
+				t.Errorf("payload key = %v", jwk.Key)
+			}
+		})
+	}
+
+	if _, err := signEAB(&ExternalAccountBinding{Algorithm: "RS256"}, priKey.Public(), ""); err == nil {
+		t.Error("signEAB() with RS256 err = nil")
+	}
+}
+
+func TestClient_CreateAccountEABRequired(t *testing.T) {
+	ca := newFakeCA(t)
+	ca.meta = `{"externalAccountRequired":true}`
+
+	c, err := NewClient(context.Background(), &Config{DirURL: ca.url("/dir")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.CreateAccountWithEmail(context.Background(), "acme@test.xdns.cupx.net", true); !errors.Is(err, ErrExternalAccountRequired) {
+		t.Errorf("CreateAccountWithEmail() without eab err = %v, want %v", err, ErrExternalAccountRequired)
+	}
+
+	hmacKey := base64.RawURLEncoding.EncodeToString([]byte("0123456789abcdef0123456789abcdef"))
+	acct, err := c.CreateAccountWithEmail(context.Background(), "acme@test.xdns.cupx.net", true,
+		WithExternalAccountBinding("kid-1", hmacKey, EABAlgHS256))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if acct.AcctURL == "" {
+		t.Error("CreateAccountWithEmail() with eab returned no account URL")
+	}
+}
@@ -0,0 +1,214 @@
+// Copyright 2020 The CupX Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xacme
+
+import (
+	"errors"
+	"strings"
+	"time"
+)
+
+const acmeErrorNS = "urn:ietf:params:acme:error:"
+
+var (
+	// ErrAlreadyRevoked matches errors of the acme server saying the certificate is already revoked.
+	ErrAlreadyRevoked = errors.New("cupx/xacme: certificate already revoked")
+	// ErrUnauthorized matches errors of the acme server saying the client lacks authorization.
+	ErrUnauthorized = errors.New("cupx/xacme: unauthorized")
+	// ErrAccountDoesNotExist matches errors of the acme server saying the account key is unknown.
+	ErrAccountDoesNotExist = errors.New("cupx/xacme: account does not exist")
+	// ErrUserActionRequired matches errors of the acme server asking to visit a URL,
+	// e.g. to agree to new terms of service.
+	ErrUserActionRequired = errors.New("cupx/xacme: user action required")
+	// ErrTermsOfServiceNotAgreed is returned when creating an account without agreeing
+	// to the terms of service of the CA.
+	ErrTermsOfServiceNotAgreed = errors.New("cupx/xacme: terms of service not agreed")
+	// ErrRateLimited matches errors of the acme server saying a rate limit is exceeded.
+	ErrRateLimited = errors.New("cupx/xacme: rate limited")
+	// ErrBadNonce matches errors of the acme server rejecting the nonce.
+	ErrBadNonce = errors.New("cupx/xacme: bad nonce")
+	// ErrCAA matches errors of the acme server saying a CAA record forbids issuance.
+	ErrCAA = errors.New("cupx/xacme: issuance forbidden by CAA")
+	// ErrRejectedIdentifier matches errors of the acme server refusing to issue for an identifier.
+	ErrRejectedIdentifier = errors.New("cupx/xacme: rejected identifier")
+	// ErrUnsupportedIdentifier matches errors of the acme server not supporting an identifier type.
+	ErrUnsupportedIdentifier = errors.New("cupx/xacme: unsupported identifier")
+	// ErrMalformed matches errors of the acme server saying the request is malformed.
+	ErrMalformed = errors.New("cupx/xacme: malformed request")
+	// ErrServerInternal matches internal errors of the acme server.
+	ErrServerInternal = errors.New("cupx/xacme: server internal error")
+	// ErrBadCSR matches errors of the acme server rejecting the csr.
+	ErrBadCSR = errors.New("cupx/xacme: bad csr")
+	// ErrOrderNotReady matches errors of the acme server saying the order can't be finalized yet.
+	ErrOrderNotReady = errors.New("cupx/xacme: order not ready")
+	// ErrConnection matches errors of the acme server failing to connect to the challenge server.
+	ErrConnection = errors.New("cupx/xacme: connection error")
+	// ErrDNS matches errors of the acme server failing a dns lookup.
+	ErrDNS = errors.New("cupx/xacme: dns error")
+	// ErrIncorrectResponse matches errors of the acme server receiving a wrong challenge response.
+	ErrIncorrectResponse = errors.New("cupx/xacme: incorrect challenge response")
+	// ErrTLS matches errors of the acme server failing a tls connection during validation.
+	ErrTLS = errors.New("cupx/xacme: tls error")
+	// ErrExternalAccountRequired matches errors of the acme server requiring external account binding.
+	ErrExternalAccountRequired = errors.New("cupx/xacme: external account required")
+	// ErrAlreadyReplaced matches errors of the acme server saying the certificate of the replaces
+	// field of a new order is already replaced, see the acme renewal information draft.
+	ErrAlreadyReplaced = errors.New("cupx/xacme: certificate already replaced")
+)
+
+// acmeErrorTypes maps the sentinel errors to acme error types, see rfc8555 section 6.7.
+var acmeErrorTypes = map[error]string{
+	ErrAlreadyRevoked:          acmeErrorNS + "alreadyRevoked",
+	ErrUnauthorized:            acmeErrorNS + "unauthorized",
+	ErrAccountDoesNotExist:     acmeErrorNS + "accountDoesNotExist",
+	ErrUserActionRequired:      acmeErrorNS + "userActionRequired",
+	ErrRateLimited:             acmeErrorNS + "rateLimited",
+	ErrBadNonce:                acmeErrorNS + "badNonce",
+	ErrCAA:                     acmeErrorNS + "caa",
+	ErrRejectedIdentifier:      acmeErrorNS + "rejectedIdentifier",
+	ErrUnsupportedIdentifier:   acmeErrorNS + "unsupportedIdentifier",
+	ErrMalformed:               acmeErrorNS + "malformed",
+	ErrServerInternal:          acmeErrorNS + "serverInternal",
+	ErrBadCSR:                  acmeErrorNS + "badCSR",
+	ErrOrderNotReady:           acmeErrorNS + "orderNotReady",
+	ErrConnection:              acmeErrorNS + "connection",
+	ErrDNS:                     acmeErrorNS + "dns",
+	ErrIncorrectResponse:       acmeErrorNS + "incorrectResponse",
+	ErrTLS:                     acmeErrorNS + "tls",
+	ErrExternalAccountRequired: acmeErrorNS + "externalAccountRequired",
+	ErrAlreadyReplaced:         acmeErrorNS + "alreadyReplaced",
+}
+
+// ProblemError is a problem document returned by the acme server, see rfc7807 and rfc8555 section 6.7.
+// It matches the sentinel errors of its type and of its subproblems with errors.Is.
+type ProblemError struct {
+	// HTTPStatus is the status code of the response carrying the problem.
+	HTTPStatus int
+	Type       string
+	Title      string
+	// Status is the status code set by the acme server in the problem document.
+	Status   int
+	Detail   string
+	Instance string
+	// Identifier is the identifier a subproblem relates to.
+	Identifier *IdlIdentifier
+	// Subproblems are the per identifier problems of a compound error, see rfc8555 section 6.7.1.
+	Subproblems []*ProblemError
+	// RetryAfter is the Retry-After of the response, it is zero if there is none.
+	RetryAfter time.Duration
+}
+
+// newProblemError returns the ProblemError of the problem document idl.
+func newProblemError(httpStatus int, idl *IdlRespErr) *ProblemError {
+	e := &ProblemError{
+		HTTPStatus: httpStatus,
+		Type:       idl.Type,
+		Title:      idl.Title,
+		Status:     idl.Status,
+		Detail:     idl.Detail,
+		Instance:   idl.Instance,
+		Identifier: idl.Identifier,
+	}
+	for i := range idl.Subproblems {
+		e.Subproblems = append(e.Subproblems, newProblemError(httpStatus, &idl.Subproblems[i]))
+	}
+	return e
+}
+
+func (e *ProblemError) Error() string {
+	var b strings.Builder
+	b.WriteString("cupx/xacme.client.acmePost: " + e.Type + " " + e.Detail)
+	for _, sub := range e.Subproblems {
+		b.WriteString("; ")
+		if sub.Identifier != nil {
+			b.WriteString(sub.Identifier.Value + ": ")
+		}
+		b.WriteString(sub.Type + " " + sub.Detail)
+	}
+	return b.String()
+}
+
+// Is reports whether e or one of its subproblems matches a sentinel error,
+// e.g. errors.Is(err, ErrRateLimited).
+func (e *ProblemError) Is(target error) bool {
+	typ, ok := acmeErrorTypes[target]
+	if !ok {
+		return false
+	}
+	if typ == e.Type {
+		return true
+	}
+	for _, sub := range e.Subproblems {
+		if sub.Is(target) {
+			return true
+		}
+	}
+	return false
+}
+
+// MultiError collects the errors of steps which all run even if some fail,
+// e.g. the authorizations of an order and the cleanup of their challenges.
+type MultiError []error
+
+// joinErrors returns the non nil errs as MultiError, nil if there is none,
+// or the error itself if there is only one.
+func joinErrors(errs ...error) error {
+	var me MultiError
+	for _, err := range errs {
+		if err == nil {
+			continue
+		}
+		if m, ok := err.(MultiError); ok {
+			me = append(me, m...)
+			continue
+		}
+		me = append(me, err)
+	}
+	switch len(me) {
+	case 0:
+		return nil
+	case 1:
+		return me[0]
+	}
+	return me
+}
+
+func (e MultiError) Error() string {
+	s := make([]string, len(e))
+	for i, err := range e {
+		s[i] = err.Error()
+	}
+	return strings.Join(s, "; ")
+}
+
+// Is reports whether any of the errors matches target.
+func (e MultiError) Is(target error) bool {
+	for _, err := range e {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// As finds the first of the errors that matches target.
+func (e MultiError) As(target interface{}) bool {
+	for _, err := range e {
+		if errors.As(err, target) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,98 @@
+// Copyright 2020 The CupX Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xacme
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestClient_acmePostProblem(t *testing.T) {
+	ca := newFakeCA(t)
+	ca.handle("/compound", func(w http.ResponseWriter, r *fakeCAReq) {
+		w.Header().Set("Content-Type", "application/problem+json")
+		w.WriteHeader(http.StatusForbidden)
+		_, _ = w.Write([]byte(`{
+			"type": "urn:ietf:params:acme:error:malformed",
+			"title": "Some of the identifiers requested were rejected",
+			"status": 403,
+			"detail": "Some of the identifiers requested were rejected",
+			"instance": "https://ca.test.xdns.cupx.net/problems/1",
+			"subproblems": [{
+				"type": "urn:ietf:params:acme:error:rejectedIdentifier",
+				"detail": "This CA will not issue for \"example.net\"",
+				"identifier": {"type": "dns", "value": "example.net"}
+			}, {
+				"type": "urn:ietf:params:acme:error:caa",
+				"detail": "CAA record forbids issuance",
+				"identifier": {"type": "dns", "value": "caa.test.xdns.cupx.net"}
+			}]
+		}`))
+	})
+	badNonces := 0
+	ca.handle("/nonce", func(w http.ResponseWriter, r *fakeCAReq) {
+		if badNonces > 0 {
+			badNonces--
+			ca.problem(w, http.StatusBadRequest, "badNonce", "stale nonce")
+		}
+	})
+	ca.handle("/limited", func(w http.ResponseWriter, r *fakeCAReq) {
+		ca.problem(w, http.StatusTooManyRequests, "rateLimited", "too many certificates")
+	})
+	c := ca.newClient(WithRetryPolicy(RetryPolicy{MaxAttempts: 1}))
+	ctx := context.Background()
+
+	_, _, err := c.acmePost(ctx, ca.url("/compound"), nil)
+	var perr *ProblemError
+	if !errors.As(err, &perr) {
+		t.Fatalf("acmePost() err = %v, want *ProblemError", err)
+	}
+	if perr.HTTPStatus != http.StatusForbidden || perr.Status != 403 ||
+		perr.Instance != "https://ca.test.xdns.cupx.net/problems/1" || len(perr.Subproblems) != 2 {
+		t.Errorf("ProblemError = %+v", perr)
+	}
+	if sub := perr.Subproblems[0]; sub.Identifier == nil || sub.Identifier.Value != "example.net" {
+		t.Errorf("subproblem = %+v", sub)
+	}
+	for _, target := range []error{ErrMalformed, ErrRejectedIdentifier, ErrCAA} {
+		if !errors.Is(err, target) {
+			t.Errorf("errors.Is(err, %v) = false", target)
+		}
+	}
+	if errors.Is(err, ErrRateLimited) {
+		t.Error("errors.Is(err, ErrRateLimited) = true")
+	}
+	if !strings.Contains(err.Error(), "caa.test.xdns.cupx.net: urn:ietf:params:acme:error:caa") {
+		t.Errorf("Error() = %v", err)
+	}
+
+	_, _, err = c.acmePost(ctx, ca.url("/limited"), nil)
+	if !errors.As(err, &perr) || perr.HTTPStatus != http.StatusTooManyRequests || !errors.Is(err, ErrRateLimited) {
+		t.Errorf("acmePost() rate limited err = %v", err)
+	}
+
+	// two bad nonces are retried, three are returned.
+	badNonces = 2
+	if _, _, err := c.acmePost(ctx, ca.url("/nonce"), nil); err != nil {
+		t.Errorf("acmePost() err = %v", err)
+	}
+	badNonces = 3
+	if _, _, err := c.acmePost(ctx, ca.url("/nonce"), nil); !errors.Is(err, ErrBadNonce) {
+		t.Errorf("acmePost() err = %v, want %v", err, ErrBadNonce)
+	}
+}
@@ -0,0 +1,532 @@
+// Copyright 2020 The CupX Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xacme
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"gopkg.in/square/go-jose.v2"
+)
+
+// fakeCA is a minimal acme server which verifies the JWS of every POST request
+// and passes it to the handler registered for its path.
+type fakeCA struct {
+	t        *testing.T
+	srv      *httptest.Server
+	mu       sync.Mutex
+	nonce    int
+	accounts map[string]*jose.JSONWebKey
+	handlers map[string]func(w http.ResponseWriter, r *fakeCAReq)
+	prefixes map[string]func(w http.ResponseWriter, r *fakeCAReq)
+	meta     string
+	// renewalInfo answers the GET requests of acme renewal information if it is set
+	// before the directory is fetched.
+	renewalInfo func(w http.ResponseWriter, certID string)
+}
+
+type fakeCAReq struct {
+	Alg     string
+	KeyID   string
+	JWK     *jose.JSONWebKey
+	URL     string
+	Payload []byte
+}
+
+func newFakeCA(t *testing.T) *fakeCA {
+	ca := &fakeCA{
+		t:        t,
+		accounts: make(map[string]*jose.JSONWebKey),
+		handlers: make(map[string]func(w http.ResponseWriter, r *fakeCAReq)),
+		prefixes: make(map[string]func(w http.ResponseWriter, r *fakeCAReq)),
+		meta:     "{}",
+	}
+	ca.srv = httptest.NewServer(http.HandlerFunc(ca.serveHTTP))
+	t.Cleanup(ca.srv.Close)
+
+	ca.handle("/new-acct", func(w http.ResponseWriter, r *fakeCAReq) {
+		if r.JWK == nil {
+			ca.problem(w, http.StatusBadRequest, "malformed", "jwk required")
+			return
+		}
+		p := &IdlReqNewAccountPayload{}
+		decodeJSON(t, r.Payload, p)
+		if kid := ca.lookupAccount(r.JWK); kid != "" {
+			w.Header().Set("Location", kid)
+			_, _ = w.Write([]byte(`{"status":"valid"}`))
+			return
+		}
+		if p.OnlyReturnExisting {
+			ca.problem(w, http.StatusBadRequest, "accountDoesNotExist", "no account for key")
+			return
+		}
+		if !p.TermsOfServiceAgreed {
+			ca.problem(w, http.StatusForbidden, "userActionRequired", "terms of service not agreed")
+			return
+		}
+		ca.mu.Lock()
+		kid := ca.url(fmt.Sprintf("/acct/%d", len(ca.accounts)+1))
+		ca.accounts[kid] = r.JWK
+		ca.mu.Unlock()
+		w.Header().Set("Location", kid)
+		w.WriteHeader(http.StatusCreated)
+		_, _ = w.Write([]byte(`{"status":"valid"}`))
+	})
+
+	return ca
+}
+
+func (ca *fakeCA) url(path string) string {
+	return ca.srv.URL + path
+}
+
+func (ca *fakeCA) handle(path string, h func(w http.ResponseWriter, r *fakeCAReq)) {
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	ca.handlers[path] = h
+}
+
+func (ca *fakeCA) handlePrefix(prefix string, h func(w http.ResponseWriter, r *fakeCAReq)) {
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	ca.prefixes[prefix] = h
+}
+
+func (ca *fakeCA) lookupAccount(jwk *jose.JSONWebKey) string {
+	tp, _ := jwk.Thumbprint(crypto.SHA256)
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	for kid, k := range ca.accounts {
+		ktp, _ := k.Thumbprint(crypto.SHA256)
+		if string(ktp) == string(tp) {
+			return kid
+		}
+	}
+	return ""
+}
+
+func (ca *fakeCA) problem(w http.ResponseWriter, status int, typ string, detail string) {
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(status)
+	_, _ = fmt.Fprintf(w, `{"type":"urn:ietf:params:acme:error:%s","detail":%q,"status":%d}`, typ, detail, status)
+}
+
+func (ca *fakeCA) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	ca.mu.Lock()
+	ca.nonce++
+	w.Header().Set("Replay-Nonce", fmt.Sprintf("nonce-%d", ca.nonce))
+	ca.mu.Unlock()
+
+	switch r.URL.Path {
+	case "/dir":
+		var renewalInfo string
+		if ca.renewalInfo != nil {
+			renewalInfo = ca.url("/renewal-info/")
+		}
+		_, _ = fmt.Fprintf(w, `{"newNonce":%q,"newAccount":%q,"newOrder":%q,"revokeCert":%q,"keyChange":%q,"renewalInfo":%q,"meta":%s}`,
+			ca.url("/new-nonce"), ca.url("/new-acct"), ca.url("/new-order"), ca.url("/revoke-cert"), ca.url("/key-change"), renewalInfo, ca.meta)
+		return
+	case "/new-nonce":
+		return
+	}
+	if ca.renewalInfo != nil && r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, "/renewal-info/") {
+		ca.renewalInfo(w, strings.TrimPrefix(r.URL.Path, "/renewal-info/"))
+		return
+	}
+
+	ca.mu.Lock()
+	h, ok := ca.handlers[r.URL.Path]
+	for prefix, ph := range ca.prefixes {
+		if !ok && strings.HasPrefix(r.URL.Path, prefix) {
+			h, ok = ph, true
+		}
+	}
+	ca.mu.Unlock()
+	if !ok || r.Method != http.MethodPost {
+		http.NotFound(w, r)
+		return
+	}
+
+	body, _ := ioutil.ReadAll(r.Body)
+	jws, err := jose.ParseSigned(string(body))
+	if err != nil {
+		ca.problem(w, http.StatusBadRequest, "malformed", err.Error())
+		return
+	}
+	h0 := jws.Signatures[0].Protected
+	req := &fakeCAReq{Alg: h0.Algorithm, KeyID: h0.KeyID, JWK: h0.JSONWebKey}
+	req.URL, _ = h0.ExtraHeaders["url"].(string)
+	if req.URL != ca.url(r.URL.Path) {
+		ca.problem(w, http.StatusUnauthorized, "unauthorized", "url mismatch")
+		return
+	}
+
+	key := req.JWK
+	if key == nil {
+		ca.mu.Lock()
+		key = ca.accounts[req.KeyID]
+		ca.mu.Unlock()
+		if key == nil {
+			ca.problem(w, http.StatusBadRequest, "accountDoesNotExist", "unknown kid "+req.KeyID)
+			return
+		}
+	}
+	req.Payload, err = jws.Verify(key)
+	if err != nil {
+		ca.problem(w, http.StatusUnauthorized, "unauthorized", err.Error())
+		return
+	}
+
+	h(w, req)
+}
+
+// newClient returns a client of ca with a fresh account.
+func (ca *fakeCA) newClient(opts ...Option) *client {
+	c, err := NewClient(context.Background(), &Config{DirURL: ca.url("/dir")}, opts...)
+	if err != nil {
+		ca.t.Fatal(err)
+	}
+	if _, err := c.CreateAccountWithEmail(context.Background(), "acme@test.xdns.cupx.net", true); err != nil {
+		ca.t.Fatal(err)
+	}
+	return c.(*client)
+}
+
+func decodeJSON(t *testing.T, b []byte, v interface{}) {
+	if err := json.Unmarshal(b, v); err != nil {
+		t.Fatalf("%v: %s", err, strings.TrimSpace(string(b)))
+	}
+}
+
+type fakeOrder struct {
+	ID             int             `json:"-"`
+	Status         string          `json:"status"`
+	Identifiers    []IdlIdentifier `json:"identifiers"`
+	Authorizations []string        `json:"authorizations"`
+	Finalize       string          `json:"finalize"`
+	Certificate    string          `json:"certificate,omitempty"`
+	Error          json.RawMessage `json:"error,omitempty"`
+	polls          int
+}
+
+type fakeAuthz struct {
+	ID         int             `json:"-"`
+	Status     string          `json:"status"`
+	Identifier IdlIdentifier   `json:"identifier"`
+	Wildcard   bool            `json:"wildcard,omitempty"`
+	Challenges []fakeChallenge `json:"challenges"`
+}
+
+type fakeChallenge struct {
+	Type   string          `json:"type"`
+	URL    string          `json:"url"`
+	Token  string          `json:"token"`
+	Status string          `json:"status"`
+	Error  json.RawMessage `json:"error,omitempty"`
+	// KeyAuth is the expected key authorization.
+	KeyAuth string `json:"-"`
+}
+
+// fakeOrders issues certificates for fakeCA.
+type fakeOrders struct {
+	ca     *fakeCA
+	orders []*fakeOrder
+	authzs []*fakeAuthz
+	certs  [][]byte
+	caKey  *ecdsa.PrivateKey
+	caCert *x509.Certificate
+	// ChallengeTypes are offered by every authorization.
+	ChallengeTypes []string
+	// Validate validates a challenge, it accepts every challenge if nil.
+	Validate func(authz *fakeAuthz, ch *fakeChallenge) bool
+	// ProcessingPolls is how many times the order stays processing after finalize.
+	ProcessingPolls int
+	// RetryAfter is the Retry-After of processing orders.
+	RetryAfter string
+	// FinalizeProblem is the acme error type returned by finalize if not empty.
+	FinalizeProblem string
+	// InvalidAfterProcessing makes processing orders invalid instead of valid.
+	InvalidAfterProcessing bool
+	// CSRs are the csr received by finalize.
+	CSRs []*x509.CertificateRequest
+	// Replaces are the replaces fields of the new orders.
+	Replaces []string
+}
+
+func (ca *fakeCA) enableOrders() *fakeOrders {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		ca.t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "xacme fake root"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		SubjectKeyId:          []byte{1, 2, 3, 4},
+		AuthorityKeyId:        []byte{1, 2, 3, 4},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &caKey.PublicKey, caKey)
+	if err != nil {
+		ca.t.Fatal(err)
+	}
+	caCert, _ := x509.ParseCertificate(der)
+
+	fo := &fakeOrders{
+		ca:             ca,
+		caKey:          caKey,
+		caCert:         caCert,
+		ChallengeTypes: []string{ChallengeTypeDNS01, ChallengeTypeHTTP01},
+	}
+	ca.handle("/new-order", fo.newOrder)
+	ca.handlePrefix("/order/", fo.order)
+	ca.handlePrefix("/authz/", fo.authz)
+	ca.handlePrefix("/chall/", fo.challenge)
+	ca.handlePrefix("/finalize/", fo.finalize)
+	ca.handlePrefix("/cert/", fo.cert)
+	return fo
+}
+
+func (fo *fakeOrders) write(w http.ResponseWriter, status int, v interface{}) {
+	b, _ := json.Marshal(v)
+	w.WriteHeader(status)
+	_, _ = w.Write(b)
+}
+
+func (fo *fakeOrders) newOrder(w http.ResponseWriter, r *fakeCAReq) {
+	p := &IdlReqNewOrderPayload{}
+	decodeJSON(fo.ca.t, r.Payload, p)
+
+	fo.ca.mu.Lock()
+	defer fo.ca.mu.Unlock()
+	tp, _ := fo.ca.accounts[r.KeyID].Thumbprint(crypto.SHA256)
+	fo.Replaces = append(fo.Replaces, p.Replaces)
+	o := &fakeOrder{ID: len(fo.orders), Status: "pending", Identifiers: p.Identifiers}
+	o.Finalize = fo.ca.url(fmt.Sprintf("/finalize/%d", o.ID))
+	for _, id := range p.Identifiers {
+		a := &fakeAuthz{ID: len(fo.authzs), Status: "pending", Identifier: id}
+		if strings.HasPrefix(id.Value, "*.") {
+			a.Identifier.Value = strings.TrimPrefix(id.Value, "*.")
+			a.Wildcard = true
+		}
+		for _, typ := range fo.ChallengeTypes {
+			if a.Wildcard && typ != ChallengeTypeDNS01 {
+				continue
+			}
+			token := fmt.Sprintf("token-%d-%s", a.ID, typ)
+			a.Challenges = append(a.Challenges, fakeChallenge{
+				Type:    typ,
+				URL:     fo.ca.url(fmt.Sprintf("/chall/%d/%s", a.ID, typ)),
+				Token:   token,
+				Status:  "pending",
+				KeyAuth: token + "." + base64.RawURLEncoding.EncodeToString(tp),
+			})
+		}
+		fo.authzs = append(fo.authzs, a)
+		o.Authorizations = append(o.Authorizations, fo.ca.url(fmt.Sprintf("/authz/%d", a.ID)))
+	}
+	fo.orders = append(fo.orders, o)
+	w.Header().Set("Location", fo.ca.url(fmt.Sprintf("/order/%d", o.ID)))
+	fo.write(w, http.StatusCreated, o)
+}
+
+// status updates the status of a pending or processing order, it is called with ca.mu held.
+func (fo *fakeOrders) status(o *fakeOrder) {
+	if o.Status == "processing" {
+		o.polls++
+		if o.polls > fo.ProcessingPolls {
+			o.Status = "valid"
+			if fo.InvalidAfterProcessing {
+				o.Status, o.Certificate = "invalid", ""
+				o.Error = json.RawMessage(`{"type":"urn:ietf:params:acme:error:serverInternal","detail":"signing failed"}`)
+			}
+		}
+		return
+	}
+	if o.Status != "pending" {
+		return
+	}
+	ready := true
+	for _, u := range o.Authorizations {
+		var id int
+		_, _ = fmt.Sscanf(u, fo.ca.url("/authz/%d"), &id)
+		switch fo.authzs[id].Status {
+		case "invalid":
+			o.Status = "invalid"
+			o.Error = json.RawMessage(`{"type":"urn:ietf:params:acme:error:unauthorized","detail":"authorization failed"}`)
+			return
+		case "pending":
+			ready = false
+		}
+	}
+	if ready {
+		o.Status = "ready"
+	}
+}
+
+func (fo *fakeOrders) order(w http.ResponseWriter, r *fakeCAReq) {
+	var id int
+	_, _ = fmt.Sscanf(r.URL, fo.ca.url("/order/%d"), &id)
+	fo.ca.mu.Lock()
+	defer fo.ca.mu.Unlock()
+	o := fo.orders[id]
+	fo.status(o)
+	if o.Status == "processing" && fo.RetryAfter != "" {
+		w.Header().Set("Retry-After", fo.RetryAfter)
+	}
+	fo.write(w, http.StatusOK, o)
+}
+
+func (fo *fakeOrders) authz(w http.ResponseWriter, r *fakeCAReq) {
+	var id int
+	_, _ = fmt.Sscanf(r.URL, fo.ca.url("/authz/%d"), &id)
+	fo.ca.mu.Lock()
+	defer fo.ca.mu.Unlock()
+	fo.write(w, http.StatusOK, fo.authzs[id])
+}
+
+func (fo *fakeOrders) challenge(w http.ResponseWriter, r *fakeCAReq) {
+	var id int
+	_, _ = fmt.Sscanf(r.URL, fo.ca.url("/chall/%d/"), &id)
+	fo.ca.mu.Lock()
+	a := fo.authzs[id]
+	var ch *fakeChallenge
+	for i := range a.Challenges {
+		if a.Challenges[i].URL == r.URL {
+			ch = &a.Challenges[i]
+		}
+	}
+	validate := fo.Validate
+	fo.ca.mu.Unlock()
+
+	ok := validate == nil || validate(a, ch)
+
+	fo.ca.mu.Lock()
+	defer fo.ca.mu.Unlock()
+	ch.Status, a.Status = "valid", "valid"
+	if !ok {
+		ch.Status, a.Status = "invalid", "invalid"
+		ch.Error = json.RawMessage(`{"type":"urn:ietf:params:acme:error:incorrectResponse","detail":"key authorization mismatch"}`)
+	}
+	fo.write(w, http.StatusOK, ch)
+}
+
+func (fo *fakeOrders) finalize(w http.ResponseWriter, r *fakeCAReq) {
+	var id int
+	_, _ = fmt.Sscanf(r.URL, fo.ca.url("/finalize/%d"), &id)
+	p := &struct {
+		CSR string `json:"csr"`
+	}{}
+	decodeJSON(fo.ca.t, r.Payload, p)
+	der, _ := base64.RawURLEncoding.DecodeString(p.CSR)
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		fo.ca.problem(w, http.StatusBadRequest, "badCSR", err.Error())
+		return
+	}
+
+	fo.ca.mu.Lock()
+	defer fo.ca.mu.Unlock()
+	if fo.FinalizeProblem != "" {
+		fo.ca.problem(w, http.StatusBadRequest, fo.FinalizeProblem, "finalize failed")
+		return
+	}
+	o := fo.orders[id]
+	fo.status(o)
+	if o.Status != "ready" {
+		fo.ca.problem(w, http.StatusForbidden, "orderNotReady", "order is "+o.Status)
+		return
+	}
+	fo.CSRs = append(fo.CSRs, csr)
+
+	tmpl := &x509.Certificate{
+		SerialNumber:   big.NewInt(int64(len(fo.certs) + 2)),
+		Subject:        csr.Subject,
+		DNSNames:       csr.DNSNames,
+		IPAddresses:    csr.IPAddresses,
+		NotBefore:      time.Now().Add(-time.Minute),
+		NotAfter:       time.Now().Add(90 * 24 * time.Hour),
+		AuthorityKeyId: fo.caCert.SubjectKeyId,
+	}
+	certDer, err := x509.CreateCertificate(rand.Reader, tmpl, fo.caCert, csr.PublicKey, fo.caKey)
+	if err != nil {
+		fo.ca.t.Fatal(err)
+	}
+	chain := append(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDer}),
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: fo.caCert.Raw})...)
+	o.Certificate = fo.ca.url(fmt.Sprintf("/cert/%d", len(fo.certs)))
+	fo.certs = append(fo.certs, chain)
+
+	o.Status = "valid"
+	if fo.ProcessingPolls > 0 {
+		o.Status = "processing"
+	}
+	fo.write(w, http.StatusOK, o)
+}
+
+func (fo *fakeOrders) cert(w http.ResponseWriter, r *fakeCAReq) {
+	var id int
+	_, _ = fmt.Sscanf(r.URL, fo.ca.url("/cert/%d"), &id)
+	fo.ca.mu.Lock()
+	defer fo.ca.mu.Unlock()
+	w.Header().Set("Content-Type", "application/pem-certificate-chain")
+	_, _ = w.Write(fo.certs[id])
+}
+
+// recordSolver records the challenges it solves.
+type recordSolver struct {
+	mu       sync.Mutex
+	presents []*Challenge
+	cleanups []*Challenge
+	err      error
+}
+
+func (s *recordSolver) Present(ctx context.Context, ch *Challenge) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.presents = append(s.presents, ch)
+	return s.err
+}
+
+func (s *recordSolver) Wait(ctx context.Context, ch *Challenge) error {
+	return nil
+}
+
+func (s *recordSolver) CleanUp(ctx context.Context, ch *Challenge) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cleanups = append(s.cleanups, ch)
+	return nil
+}
@@ -0,0 +1,133 @@
+// Copyright 2020 The CupX Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xacme
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// HTTPChallengePath is the path prefix of http-01 challenge resources.
+const HTTPChallengePath = "/.well-known/acme-challenge/"
+
+// ErrKeyAuthNotFound is returned by HTTPChallengeStore when a token is unknown.
+var ErrKeyAuthNotFound = errors.New("cupx/xacme: key authorization not found")
+
+// HTTPChallengeStore stores the key authorizations of pending http-01 challenges.
+// Implement it on top of a shared storage when several servers sit behind one load balancer.
+type HTTPChallengeStore interface {
+	// PutKeyAuth stores the key authorization of token.
+	PutKeyAuth(token string, keyAuth string) error
+	// GetKeyAuth returns the key authorization of token, or ErrKeyAuthNotFound.
+	GetKeyAuth(token string) (string, error)
+	// DeleteKeyAuth deletes the key authorization of token.
+	DeleteKeyAuth(token string) error
+}
+
+// MemHTTPChallengeStore implements HTTPChallengeStore in memory.
+type MemHTTPChallengeStore struct {
+	mu       sync.RWMutex
+	keyAuths map[string]string
+}
+
+// NewMemHTTPChallengeStore returns MemHTTPChallengeStore.
+func NewMemHTTPChallengeStore() *MemHTTPChallengeStore {
+	return &MemHTTPChallengeStore{keyAuths: make(map[string]string)}
+}
+
+func (s *MemHTTPChallengeStore) PutKeyAuth(token string, keyAuth string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.keyAuths[token] = keyAuth
+	return nil
+}
+
+func (s *MemHTTPChallengeStore) GetKeyAuth(token string) (string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	keyAuth, ok := s.keyAuths[token]
+	if !ok {
+		return "", ErrKeyAuthNotFound
+	}
+	return keyAuth, nil
+}
+
+func (s *MemHTTPChallengeStore) DeleteKeyAuth(token string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.keyAuths, token)
+	return nil
+}
+
+// NewHTTPChallengeHandler returns a http.Handler which serves HTTPChallengePath from store.
+// Other requests are passed to fallback, or answered with 404 if fallback is nil.
+func NewHTTPChallengeHandler(store HTTPChallengeStore, fallback http.Handler) http.Handler {
+	if fallback == nil {
+		fallback = http.NotFoundHandler()
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, HTTPChallengePath) {
+			fallback.ServeHTTP(w, r)
+			return
+		}
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		token := strings.TrimPrefix(r.URL.Path, HTTPChallengePath)
+		keyAuth, err := store.GetKeyAuth(token)
+		if err != nil {
+			if errors.Is(err, ErrKeyAuthNotFound) {
+				http.NotFound(w, r)
+				return
+			}
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/octet-stream")
+		_, _ = w.Write([]byte(keyAuth))
+	})
+}
+
+// HTTPSolver solves http-01 challenges with HTTPChallengeStore.
+// The key authorizations are served by NewHTTPChallengeHandler.
+type HTTPSolver struct {
+	Store HTTPChallengeStore
+}
+
+// NewHTTPSolver returns HTTPSolver.
+func NewHTTPSolver(store HTTPChallengeStore) *HTTPSolver {
+	return &HTTPSolver{Store: store}
+}
+
+func (s *HTTPSolver) Present(ctx context.Context, ch *Challenge) error {
+	return s.Store.PutKeyAuth(ch.Token, ch.KeyAuthorization)
+}
+
+func (s *HTTPSolver) Wait(ctx context.Context, ch *Challenge) error {
+	return nil
+}
+
+func (s *HTTPSolver) CleanUp(ctx context.Context, ch *Challenge) error {
+	return s.Store.DeleteKeyAuth(ch.Token)
+}
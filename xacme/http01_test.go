@@ -0,0 +1,82 @@
+// Copyright 2020 The CupX Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xacme
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNewHTTPChallengeHandler(t *testing.T) {
+	store := NewMemHTTPChallengeStore()
+	_ = store.PutKeyAuth("token1", "token1.thumbprint")
+
+	fallback := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	})
+	h := NewHTTPChallengeHandler(store, fallback)
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		code   int
+		body   string
+	}{
+		{
+			name:   "known token",
+			method: http.MethodGet,
+			path:   HTTPChallengePath + "token1",
+			code:   http.StatusOK,
+			body:   "token1.thumbprint",
+		},
+		{
+			name:   "unknown token",
+			method: http.MethodGet,
+			path:   HTTPChallengePath + "token2",
+			code:   http.StatusNotFound,
+		},
+		{
+			name:   "post",
+			method: http.MethodPost,
+			path:   HTTPChallengePath + "token1",
+			code:   http.StatusMethodNotAllowed,
+		},
+		{
+			name:   "fallback",
+			method: http.MethodGet,
+			path:   "/index.html",
+			code:   http.StatusTeapot,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest(tt.method, tt.path, nil))
+			if w.Code != tt.code {
+				t.Errorf("code = %v, want %v", w.Code, tt.code)
+			}
+			if tt.body != "" && w.Body.String() != tt.body {
+				t.Errorf("body = %v, want %v", w.Body.String(), tt.body)
+			}
+		})
+	}
+
+	_ = store.DeleteKeyAuth("token1")
+	if _, err := store.GetKeyAuth("token1"); err != ErrKeyAuthNotFound {
+		t.Errorf("GetKeyAuth() after delete err = %v, want %v", err, ErrKeyAuthNotFound)
+	}
+}
@@ -0,0 +1,77 @@
+// Copyright 2020 The CupX Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xacme
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Identifier types, see rfc8555 section 9.7.7 and rfc8738 section 3.
+const (
+	IdentifierTypeDNS = "dns"
+	IdentifierTypeIP  = "ip"
+)
+
+// ErrIPIdentifierDNS01 is returned when an ip identifier is to be validated with dns-01,
+// which only validates dns names, see rfc8738 section 7.
+var ErrIPIdentifierDNS01 = errors.New("cupx/xacme: dns-01 can't validate ip identifiers")
+
+// normalizeIdentifiers returns identifiers with the ip addresses in their canonical text form,
+// see rfc8738 section 3.
+func normalizeIdentifiers(identifiers []IdlIdentifier) ([]IdlIdentifier, error) {
+	normalized := make([]IdlIdentifier, len(identifiers))
+	for i, identifier := range identifiers {
+		if identifier.Type == IdentifierTypeIP {
+			ip := net.ParseIP(identifier.Value)
+			if ip == nil {
+				return nil, fmt.Errorf("cupx/xacme: invalid ip identifier %q", identifier.Value)
+			}
+			identifier.Value = ip.String()
+		}
+		normalized[i] = identifier
+	}
+	return normalized, nil
+}
+
+// canonicalIdentifier returns the canonical form of an identifier value to compare it,
+// ip addresses in their canonical text form and dns names in lower case.
+func canonicalIdentifier(value string) string {
+	if ip := net.ParseIP(value); ip != nil {
+		return ip.String()
+	}
+	return strings.ToLower(value)
+}
+
+// ReverseName returns the reverse dns name of ip, e.g. 4.3.2.1.in-addr.arpa for 1.2.3.4.
+// It is the SNI of tls-alpn-01 validations of ip identifiers, see rfc8738 section 6.
+func ReverseName(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return fmt.Sprintf("%d.%d.%d.%d.in-addr.arpa", ip4[3], ip4[2], ip4[1], ip4[0])
+	}
+	const hexDigits = "0123456789abcdef"
+	var b strings.Builder
+	ip16 := ip.To16()
+	for i := len(ip16) - 1; i >= 0; i-- {
+		b.WriteByte(hexDigits[ip16[i]&0xf])
+		b.WriteByte('.')
+		b.WriteByte(hexDigits[ip16[i]>>4])
+		b.WriteByte('.')
+	}
+	b.WriteString("ip6.arpa")
+	return b.String()
+}
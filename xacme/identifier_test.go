@@ -0,0 +1,116 @@
+// Copyright 2020 The CupX Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xacme
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestReverseName(t *testing.T) {
+	tests := []struct {
+		ip   string
+		want string
+	}{
+		{"192.0.2.1", "1.2.0.192.in-addr.arpa"},
+		{"::ffff:192.0.2.1", "1.2.0.192.in-addr.arpa"},
+		{"2001:db8::1", "1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa"},
+	}
+	for _, tt := range tests {
+		if got := ReverseName(net.ParseIP(tt.ip)); got != tt.want {
+			t.Errorf("ReverseName(%s) = %v, want %v", tt.ip, got, tt.want)
+		}
+	}
+}
+
+func TestClient_SignCertIP(t *testing.T) {
+	ca := newFakeCA(t)
+	fo := ca.enableOrders()
+	fo.ChallengeTypes = []string{ChallengeTypeHTTP01, ChallengeTypeTLSALPN01}
+	s := &recordSolver{}
+	c := ca.newClient(WithSolver(ChallengeTypeHTTP01, s))
+
+	sr := &IdlSignReq{Identifiers: []IdlIdentifier{
+		{Type: IdentifierTypeIP, Value: "192.0.2.1"},
+		{Type: IdentifierTypeIP, Value: "2001:DB8:0::1"},
+	}}
+	if _, err := c.SignCert(context.Background(), sr); err != nil {
+		t.Fatal(err)
+	}
+	csr := fo.CSRs[0]
+	if len(csr.DNSNames) != 0 || csr.Subject.CommonName != "" {
+		t.Errorf("csr DNSNames = %v, CommonName = %q", csr.DNSNames, csr.Subject.CommonName)
+	}
+	if len(csr.IPAddresses) != 2 || csr.IPAddresses[0].String() != "192.0.2.1" || csr.IPAddresses[1].String() != "2001:db8::1" {
+		t.Errorf("csr IPAddresses = %v", csr.IPAddresses)
+	}
+	for _, ch := range s.presents {
+		if ch.Identifier.Type != IdentifierTypeIP {
+			t.Errorf("challenge identifier = %v", ch.Identifier)
+		}
+	}
+
+	sr.Identifiers = []IdlIdentifier{{Type: IdentifierTypeIP, Value: "example.com"}}
+	if _, err := c.SignCert(context.Background(), sr); err == nil {
+		t.Error("SignCert() with invalid ip err = nil")
+	}
+}
+
+func TestDNSSolver_IP(t *testing.T) {
+	s := NewDNSSolver(&fakeXDns{}, "")
+	ch := &Challenge{Type: ChallengeTypeDNS01, Identifier: IdlIdentifier{Type: IdentifierTypeIP, Value: "192.0.2.1"}}
+	if err := s.Present(context.Background(), ch); !errors.Is(err, ErrIPIdentifierDNS01) {
+		t.Errorf("Present() err = %v, want %v", err, ErrIPIdentifierDNS01)
+	}
+	if err := s.CleanUp(context.Background(), ch); err != nil {
+		t.Errorf("CleanUp() err = %v", err)
+	}
+}
+
+func TestTLSALPNResponder_IP(t *testing.T) {
+	r := NewTLSALPNResponder()
+	ch := &Challenge{
+		Type:             ChallengeTypeTLSALPN01,
+		Identifier:       IdlIdentifier{Type: IdentifierTypeIP, Value: "2001:db8::1"},
+		KeyAuthorization: "token.thumbprint",
+	}
+	if err := r.Present(context.Background(), ch); err != nil {
+		t.Fatal(err)
+	}
+	hello := &tls.ClientHelloInfo{
+		ServerName:      ReverseName(net.ParseIP("2001:db8::1")),
+		SupportedProtos: []string{ACMETLS1Protocol},
+	}
+	cert, err := r.GetCertificate(hello)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(leaf.DNSNames) != 0 || len(leaf.IPAddresses) != 1 || !leaf.IPAddresses[0].Equal(net.ParseIP("2001:db8::1")) {
+		t.Errorf("DNSNames = %v, IPAddresses = %v", leaf.DNSNames, leaf.IPAddresses)
+	}
+
+	_ = r.CleanUp(context.Background(), ch)
+	if _, err := r.GetCertificate(hello); err == nil {
+		t.Error("GetCertificate() after CleanUp err = nil")
+	}
+}
@@ -14,37 +14,65 @@
 
 package xacme
 
+import (
+	"encoding/json"
+	"time"
+
+	"gopkg.in/square/go-jose.v2"
+)
+
+// IdlRespErr is a problem document, see rfc7807.
 type IdlRespErr struct {
-	Type   string
-	Detail string
+	Type        string
+	Title       string
+	Status      int
+	Detail      string
+	Instance    string
+	Identifier  *IdlIdentifier
+	Subproblems []IdlRespErr
 }
 
 type IdlSignReq struct {
 	Identifiers []IdlIdentifier
 	TXTCname    string
+	// TXTCnames maps identifiers to dns-01 TXT record names, see DNSSolver.TXTCnames.
+	TXTCnames map[string]string
 }
 type IdlRespDir struct {
-	KeyChange string `json:"keyChange"`
-	Meta      struct {
-		CaaIdentities  []string `json:"caaIdentities"`
-		TermsOfService string   `json:"termsOfService"`
-		Website        string
-	}
-	NewAccount string `json:"newAccount"`
-	NewNonce   string `json:"newNonce"`
-	NewOrder   string `json:"newOrder"`
-	RevokeCert string `json:"revokeCert"`
+	KeyChange  string         `json:"keyChange"`
+	Meta       IdlRespDirMeta `json:"meta"`
+	NewAccount string         `json:"newAccount"`
+	NewAuthz   string         `json:"newAuthz"`
+	NewNonce   string         `json:"newNonce"`
+	NewOrder   string         `json:"newOrder"`
+	RevokeCert string         `json:"revokeCert"`
+	// RenewalInfo is the acme renewal information endpoint, it is empty if the CA doesn't support it.
+	RenewalInfo string `json:"renewalInfo,omitempty"`
+}
+
+type IdlRespDirMeta struct {
+	CaaIdentities           []string `json:"caaIdentities"`
+	TermsOfService          string   `json:"termsOfService"`
+	Website                 string   `json:"website"`
+	ExternalAccountRequired bool     `json:"externalAccountRequired"`
 }
 
 type IdlReqNewAccountPayload struct {
-	TermsOfServiceAgreed bool `json:"termsOfServiceAgreed"`
-	Contact              []string
+	TermsOfServiceAgreed   bool            `json:"termsOfServiceAgreed,omitempty"`
+	Contact                []string        `json:"contact,omitempty"`
+	OnlyReturnExisting     bool            `json:"onlyReturnExisting,omitempty"`
+	ExternalAccountBinding json.RawMessage `json:"externalAccountBinding,omitempty"`
+}
+
+type IdlReqUpdateAccountPayload struct {
+	Contact []string `json:"contact,omitempty"`
+	Status  string   `json:"status,omitempty"`
 }
 
 type IdlRespNewAccount struct {
-	Status  string
-	Contact []string
-	Order   string
+	Status  string   `json:"status"`
+	Contact []string `json:"contact"`
+	Orders  string   `json:"orders"`
 }
 
 type IdlIdentifier struct {
@@ -56,6 +84,8 @@ type IdlReqNewOrderPayload struct {
 	Identifiers []IdlIdentifier
 	NotBefore   string `json:"NotBefore"`
 	NotAfter    string `json:"NotAfter"`
+	// Replaces is the ARI certificate ID of the certificate the order replaces.
+	Replaces string `json:"replaces,omitempty"`
 }
 
 type IdlRespNewOrder struct {
@@ -66,18 +96,34 @@ type IdlRespNewOrder struct {
 	Identifiers    []IdlIdentifier
 	Authorizations []string
 	Finalize       string
+	Certificate    string
+	Error          *IdlRespErr
 }
 
 type IdlChallenge struct {
-	Type  string
-	URL   string `json:"url"`
-	Token string
+	Type   string
+	URL    string `json:"url"`
+	Token  string
+	Status string
+	Error  *IdlRespErr
 }
 type IdlRespDownLoadAuthorizationResources struct {
 	Status     string
 	Expires    string
 	Identifier IdlIdentifier
 	Challenges []IdlChallenge
+	// Wildcard is set if the authorization is for "*." + Identifier.Value.
+	Wildcard bool
+}
+
+type IdlReqRevokeCertPayload struct {
+	Certificate string `json:"certificate"`
+	Reason      int    `json:"reason"`
+}
+
+type IdlReqKeyChangePayload struct {
+	Account string          `json:"account"`
+	OldKey  jose.JSONWebKey `json:"oldKey"`
 }
 
 type IdlRespFinalize struct {
@@ -90,3 +136,14 @@ type IdlRespFinalize struct {
 	Finalize       string
 	Certificate    string
 }
+
+// IdlRespRenewalInfo is the acme renewal information of a certificate.
+type IdlRespRenewalInfo struct {
+	SuggestedWindow IdlRenewalWindow `json:"suggestedWindow"`
+	ExplanationURL  string           `json:"explanationURL,omitempty"`
+}
+
+type IdlRenewalWindow struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+}
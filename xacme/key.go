@@ -0,0 +1,143 @@
+// Copyright 2020 The CupX Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xacme
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+)
+
+// KeyType is the algorithm and size of a certificate private key.
+type KeyType string
+
+const (
+	KeyTypeRSA2048 KeyType = "rsa2048"
+	KeyTypeRSA3072 KeyType = "rsa3072"
+	KeyTypeRSA4096 KeyType = "rsa4096"
+	KeyTypeECP256  KeyType = "ecp256"
+	KeyTypeECP384  KeyType = "ecp384"
+)
+
+// WithKeyType chooses the certificate private key type. It defaults to KeyTypeRSA2048.
+func WithKeyType(kt KeyType) Option {
+	return func(opt *option) {
+		opt.keyType = kt
+	}
+}
+
+// WithCertSigner signs the csr with signer instead of a generated key, e.g. a key kept in a HSM.
+// The returned CertInfo has no private key.
+func WithCertSigner(signer crypto.Signer) Option {
+	return func(opt *option) {
+		opt.certSigner = signer
+	}
+}
+
+// generateKey generates a private key of kt and returns it with the matching CSR signature algorithm.
+func generateKey(kt KeyType) (crypto.Signer, x509.SignatureAlgorithm, error) {
+	switch kt {
+	case "", KeyTypeRSA2048:
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		return key, x509.SHA256WithRSA, err
+	case KeyTypeRSA3072:
+		key, err := rsa.GenerateKey(rand.Reader, 3072)
+		return key, x509.SHA256WithRSA, err
+	case KeyTypeRSA4096:
+		key, err := rsa.GenerateKey(rand.Reader, 4096)
+		return key, x509.SHA256WithRSA, err
+	case KeyTypeECP256:
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		return key, x509.ECDSAWithSHA256, err
+	case KeyTypeECP384:
+		key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+		return key, x509.ECDSAWithSHA384, err
+	}
+	return nil, x509.UnknownSignatureAlgorithm, errors.New("cupx/xacme: unsupported key type " + string(kt))
+}
+
+// csrSignatureAlgorithm returns the csr signature algorithm matching pub.
+func csrSignatureAlgorithm(pub crypto.PublicKey) (x509.SignatureAlgorithm, error) {
+	switch k := pub.(type) {
+	case *rsa.PublicKey:
+		return x509.SHA256WithRSA, nil
+	case *ecdsa.PublicKey:
+		switch k.Curve {
+		case elliptic.P256():
+			return x509.ECDSAWithSHA256, nil
+		case elliptic.P384():
+			return x509.ECDSAWithSHA384, nil
+		case elliptic.P521():
+			return x509.ECDSAWithSHA512, nil
+		}
+	case ed25519.PublicKey:
+		return x509.PureEd25519, nil
+	}
+	return x509.UnknownSignatureAlgorithm, fmt.Errorf("cupx/xacme: unsupported public key type %T", pub)
+}
+
+// keyTypeOf returns the KeyType of pub, or an empty KeyType if there is none.
+func keyTypeOf(pub crypto.PublicKey) KeyType {
+	switch k := pub.(type) {
+	case *rsa.PublicKey:
+		switch k.N.BitLen() {
+		case 2048:
+			return KeyTypeRSA2048
+		case 3072:
+			return KeyTypeRSA3072
+		case 4096:
+			return KeyTypeRSA4096
+		}
+	case *ecdsa.PublicKey:
+		switch k.Curve {
+		case elliptic.P256():
+			return KeyTypeECP256
+		case elliptic.P384():
+			return KeyTypeECP384
+		}
+	}
+	return ""
+}
+
+// CsrIdentifiers returns the identifiers of the SANs of csr, or of its common name if it has no SAN.
+func CsrIdentifiers(csr *x509.CertificateRequest) []IdlIdentifier {
+	var identifiers []IdlIdentifier
+	for _, name := range csr.DNSNames {
+		identifiers = append(identifiers, IdlIdentifier{Type: IdentifierTypeDNS, Value: name})
+	}
+	for _, ip := range csr.IPAddresses {
+		identifiers = append(identifiers, IdlIdentifier{Type: IdentifierTypeIP, Value: ip.String()})
+	}
+	if len(identifiers) == 0 && csr.Subject.CommonName != "" {
+		identifiers = append(identifiers, IdlIdentifier{Type: IdentifierTypeDNS, Value: csr.Subject.CommonName})
+	}
+	return identifiers
+}
+
+// marshalPKCS8PemPrivateKey returns the PKCS#8 pem encoding of key.
+func marshalPKCS8PemPrivateKey(key crypto.Signer) (string, error) {
+	b, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return "", err
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: b})), nil
+}
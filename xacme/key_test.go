@@ -0,0 +1,133 @@
+// Copyright 2020 The CupX Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xacme
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"testing"
+)
+
+func TestClient_getCsr(t *testing.T) {
+	sr := &IdlSignReq{
+		Identifiers: []IdlIdentifier{
+			{Type: "dns", Value: "key.test.xdns.cupx.net"},
+		},
+	}
+	tests := []struct {
+		keyType KeyType
+		sigAlg  x509.SignatureAlgorithm
+		bits    int
+	}{
+		{"", x509.SHA256WithRSA, 2048},
+		{KeyTypeRSA2048, x509.SHA256WithRSA, 2048},
+		{KeyTypeRSA3072, x509.SHA256WithRSA, 3072},
+		{KeyTypeRSA4096, x509.SHA256WithRSA, 4096},
+		{KeyTypeECP256, x509.ECDSAWithSHA256, 256},
+		{KeyTypeECP384, x509.ECDSAWithSHA384, 384},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.keyType), func(t *testing.T) {
+			if testing.Short() && tt.bits > 2048 && tt.sigAlg == x509.SHA256WithRSA {
+				t.Skip("slow rsa key generation")
+			}
+			c := &client{}
+			WithKeyType(tt.keyType)(&c.opt)
+
+			der, key, err := c.getCsr(sr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req, err := x509.ParseCertificateRequest(der)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if req.SignatureAlgorithm != tt.sigAlg {
+				t.Errorf("SignatureAlgorithm = %v, want %v", req.SignatureAlgorithm, tt.sigAlg)
+			}
+
+			var bits int
+			switch k := key.(type) {
+			case *rsa.PrivateKey:
+				bits = k.N.BitLen()
+			case *ecdsa.PrivateKey:
+				bits = k.Curve.Params().BitSize
+			}
+			if bits != tt.bits {
+				t.Errorf("key bits = %v, want %v", bits, tt.bits)
+			}
+
+			pemKey, err := marshalPKCS8PemPrivateKey(key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := ParsePemPrivateKey(pemKey); err != nil {
+				t.Errorf("ParsePemPrivateKey() err = %v", err)
+			}
+		})
+	}
+
+	c := &client{}
+	WithKeyType("dsa1024")(&c.opt)
+	if _, _, err := c.getCsr(sr); err == nil {
+		t.Error("getCsr() with unsupported key type err = nil")
+	}
+}
+
+func TestClient_SignCertWithCSR(t *testing.T) {
+	ca := newFakeCA(t)
+	fo := ca.enableOrders()
+	c := ca.newClient(WithSolver(ChallengeTypeDNS01, &recordSolver{}))
+
+	key, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: "csr.test.xdns.cupx.net"},
+		DNSNames: []string{"csr.test.xdns.cupx.net", "www.csr.test.xdns.cupx.net"},
+	}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ci, err := c.SignCertWithCSR(context.Background(), csr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ci.PemCertPrivateKey != "" || ci.KeyType != KeyTypeECP384 {
+		t.Errorf("SignCertWithCSR() = %+v", ci)
+	}
+	if len(fo.CSRs) != 1 || string(fo.CSRs[0].Raw) != string(csr) {
+		t.Error("finalize csr does not match")
+	}
+
+	if _, err := c.SignCertWithCSR(context.Background(), []byte("not a csr")); err == nil {
+		t.Error("SignCertWithCSR() invalid csr err = nil")
+	}
+
+	// the certificate key is the caller supplied signer.
+	ci, err = c.SignCert(context.Background(), &IdlSignReq{Identifiers: []IdlIdentifier{{Type: "dns", Value: "signer.test.xdns.cupx.net"}}},
+		WithCertSigner(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub := fo.CSRs[1].PublicKey.(*ecdsa.PublicKey)
+	if ci.PemCertPrivateKey != "" || pub.X.Cmp(key.X) != 0 {
+		t.Error("certificate not signed for the supplied signer")
+	}
+}
@@ -0,0 +1,447 @@
+// Copyright 2020 The CupX Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xacme
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"sync"
+	"time"
+)
+
+// Clock is the time source of Manager, it is replaced to test the scheduling.
+type Clock interface {
+	Now() time.Time
+	// NewTimer returns a Timer firing after d like time.NewTimer.
+	NewTimer(d time.Duration) Timer
+}
+
+// Timer is a timer of Clock, Manager stops it once it no longer waits for it.
+type Timer interface {
+	// C returns the channel the time is sent on when the timer fires.
+	C() <-chan time.Time
+	// Stop stops the timer like time.Timer.Stop.
+	Stop() bool
+}
+
+// systemClock is the Clock of the system time.
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) NewTimer(d time.Duration) Timer {
+	return systemTimer{time.NewTimer(d)}
+}
+
+type systemTimer struct {
+	*time.Timer
+}
+
+func (t systemTimer) C() <-chan time.Time {
+	return t.Timer.C
+}
+
+// Manager keeps certificates renewed in the background. A certificate is renewed once
+// RenewAfter of its lifetime has passed plus a random jitter, and failed renewals are
+// retried with backoff until they succeed or the certificate is no longer managed.
+//
+// If the CA publishes acme renewal information, the certificates are renewed in the
+// suggested window instead, which is fetched again as told by Retry-After, and the
+// renewal orders name the certificate they replace.
+type Manager struct {
+	// Client issues the certificates with SignCert unless Issue is set.
+	Client Client
+	// Issue issues a certificate of sr with opts, e.g. with Client.SignCertWithDNS.
+	Issue func(ctx context.Context, sr *IdlSignReq, opts ...Option) (*CertInfo, error)
+	// RenewAfter is the share of the lifetime after which a certificate is renewed,
+	// it defaults to 2/3, i.e. 30 days before a 90 days certificate expires.
+	RenewAfter float64
+	// Jitter is the maximum random delay added to the renewal time, so that certificates
+	// issued together are not renewed at once. It defaults to an hour, a negative Jitter
+	// disables it.
+	Jitter time.Duration
+	// MinBackoff is the delay before retrying a failed renewal, it doubles with every failure.
+	// It defaults to a minute.
+	MinBackoff time.Duration
+	// MaxBackoff caps the delay before retrying a failed renewal, it defaults to 6 hours.
+	MaxBackoff time.Duration
+	// OnRenewed is called after a certificate is issued or renewed.
+	OnRenewed func(name string, cert *CertInfo)
+	// OnFailure is called after a renewal failed, with the time of the next attempt.
+	OnFailure func(name string, err error, retryAt time.Time)
+	// Clock is the time source, it defaults to the system time.
+	Clock Clock
+	// Storage persists the issued and renewed certificates with StoreCert under CertName of
+	// their identifiers, whatever name they are managed under, as the certificates issued with
+	// WithStorage. GetCertificate of other processes finds them under the same name.
+	// A certificate failing to be stored is kept in memory and reported to OnFailure.
+	Storage Storage
+	// HostPolicy allows GetCertificate to issue certificates on demand for the hosts it
+	// accepts, certificates are not issued on demand if it is nil.
+	HostPolicy HostPolicy
+
+	mu    sync.Mutex
+	certs map[string]*managedCert
+	// wake interrupts the wait of Run when the certificates change.
+	wake chan struct{}
+	// tlsCerts caches the parsed certificates served by GetCertificate by name.
+	tlsCerts map[string]*tlsCert
+	// pending are the GetCertificate lookups in progress by host.
+	pending map[string]*pendingCert
+	// failed are the failed on-demand issuances by host, which are not retried before the backoff.
+	failed map[string]*failedIssue
+}
+
+// managedCert is a certificate managed by Manager.
+type managedCert struct {
+	sr      *IdlSignReq
+	cert    *CertInfo
+	renewAt time.Time
+	// next is when Run renews the certificate or checks its renewal information.
+	next     time.Time
+	failures int
+	// window is the suggested window renewAt was picked in.
+	window [2]time.Time
+}
+
+// Defaults of the Manager fields left zero.
+const (
+	defaultRenewAfter = 2.0 / 3
+	defaultJitter     = time.Hour
+	defaultMinBackoff = time.Minute
+	defaultMaxBackoff = time.Hour * 6
+)
+
+// NewManager returns Manager renewing certificates with client.
+func NewManager(client Client) *Manager {
+	return &Manager{
+		Client:     client,
+		RenewAfter: defaultRenewAfter,
+		Jitter:     defaultJitter,
+		MinBackoff: defaultMinBackoff,
+		MaxBackoff: defaultMaxBackoff,
+	}
+}
+
+// Manage manages the certificate of sr under name, replacing the certificate managed under
+// name before. cert is the current certificate, the certificate is issued by Run at once if
+// it is nil.
+func (m *Manager) Manage(name string, sr *IdlSignReq, cert *CertInfo) error {
+	mc := &managedCert{sr: sr, cert: cert}
+	if cert != nil {
+		renewAt, err := m.renewalTime(cert)
+		if err != nil {
+			return fmt.Errorf("cupx/xacme.Manager.Manage: %s: %w", name, err)
+		}
+		mc.renewAt, mc.next = renewAt, renewAt
+		if m.renewalInfoSupported() {
+			// the CA may ask to renew early, e.g. because of a mass revocation.
+			mc.next = m.clock().Now()
+		}
+	}
+
+	m.mu.Lock()
+	if m.certs == nil {
+		m.certs = make(map[string]*managedCert)
+	}
+	m.certs[name] = mc
+	m.mu.Unlock()
+	m.notify()
+	return nil
+}
+
+// ManageStored manages the certificate of sr under name like Manage, starting from the
+// certificate of sr stored in Storage if there is one.
+func (m *Manager) ManageStored(ctx context.Context, name string, sr *IdlSignReq) error {
+	if m.Storage == nil {
+		return errors.New("cupx/xacme.Manager.ManageStored: no storage")
+	}
+	cert, err := LoadCert(ctx, m.Storage, CertName(sr.Identifiers))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return m.Manage(name, sr, cert)
+}
+
+// Unmanage stops renewing the certificate managed under name.
+func (m *Manager) Unmanage(name string) {
+	m.mu.Lock()
+	delete(m.certs, name)
+	m.mu.Unlock()
+	m.notify()
+}
+
+// Certificate returns the current certificate managed under name, nil if it is not issued yet.
+func (m *Manager) Certificate(name string) *CertInfo {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if mc, ok := m.certs[name]; ok {
+		return mc.cert
+	}
+	return nil
+}
+
+// RenewalTime returns when the certificate managed under name is renewed next.
+func (m *Manager) RenewalTime(name string) (time.Time, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	mc, ok := m.certs[name]
+	if !ok {
+		return time.Time{}, false
+	}
+	return mc.renewAt, true
+}
+
+// Run renews the certificates when they are due until ctx is done, it returns ctx.Err().
+// Certificates are renewed one after another so that the CA is not flooded.
+func (m *Manager) Run(ctx context.Context) error {
+	m.mu.Lock()
+	if m.wake == nil {
+		m.wake = make(chan struct{}, 1)
+	}
+	wake := m.wake
+	m.mu.Unlock()
+
+	for {
+		name, mc := m.next()
+		var timer Timer
+		var due <-chan time.Time
+		if mc != nil {
+			m.mu.Lock()
+			next := mc.next
+			m.mu.Unlock()
+			timer = m.clock().NewTimer(next.Sub(m.clock().Now()))
+			due = timer.C()
+		}
+		var err error
+		fired := false
+		select {
+		case <-ctx.Done():
+			err = ctx.Err()
+		case <-wake:
+		case <-due:
+			fired = true
+		}
+		// stopped on wake, so that a timer isn't left running on every change.
+		if timer != nil {
+			timer.Stop()
+		}
+		if err != nil {
+			return err
+		}
+		if fired && m.due(ctx, name, mc) {
+			m.renew(ctx, name, mc)
+		}
+	}
+}
+
+// next returns the certificate renewed next, nil if there is none.
+func (m *Manager) next() (string, *managedCert) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var next string
+	var nextMc *managedCert
+	for name, mc := range m.certs {
+		if nextMc == nil || mc.next.Before(nextMc.next) {
+			next, nextMc = name, mc
+		}
+	}
+	return next, nextMc
+}
+
+// due reports whether mc is to be renewed now. If the CA publishes renewal information,
+// it picks the renewal time in the suggested window and reschedules mc if it is not due yet.
+func (m *Manager) due(ctx context.Context, name string, mc *managedCert) bool {
+	if mc.cert == nil || !m.renewalInfoSupported() {
+		return true
+	}
+	ri, err := m.Client.GetRenewalInfo(ctx, mc.cert.PemCertBody)
+	if ctx.Err() != nil {
+		return false
+	}
+	now := m.clock().Now()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	recheck := defaultRenewalInfoRetryAfter
+	if err == nil {
+		// keep the time picked in a window unchanged, so that polling doesn't move it earlier.
+		if window := [2]time.Time{ri.WindowStart, ri.WindowEnd}; window != mc.window {
+			mc.window, mc.renewAt = window, ri.RenewalTime()
+		}
+		recheck = ri.RetryAfter
+	} else {
+		var perr *ProblemError
+		if errors.As(err, &perr) && perr.RetryAfter > 0 {
+			recheck = perr.RetryAfter
+		}
+	}
+	if !mc.renewAt.After(now) {
+		return true
+	}
+	mc.next = mc.renewAt
+	if t := now.Add(recheck); t.Before(mc.next) {
+		mc.next = t
+	}
+	return false
+}
+
+// renew renews mc and schedules its next renewal, or its retry if the renewal failed.
+func (m *Manager) renew(ctx context.Context, name string, mc *managedCert) {
+	var opts []Option
+	if mc.cert != nil && m.renewalInfoSupported() {
+		if certID, err := ARICertID(mc.cert.PemCertBody); err == nil {
+			opts = append(opts, WithReplaces(certID))
+		}
+	}
+	cert, err := m.issue(ctx, mc.sr, opts...)
+	if errors.Is(err, ErrAlreadyReplaced) {
+		// the certificate was replaced by another order, e.g. of a previous run.
+		cert, err = m.issue(ctx, mc.sr)
+	}
+	if ctx.Err() != nil {
+		return
+	}
+	var renewAt time.Time
+	if err == nil {
+		renewAt, err = m.renewalTime(cert)
+	}
+	var storeErr error
+	if err == nil && m.Storage != nil {
+		storeErr = StoreCert(ctx, m.Storage, CertName(mc.sr.Identifiers), cert)
+	}
+
+	m.mu.Lock()
+	if m.certs[name] != mc {
+		// unmanaged or replaced while renewing.
+		m.mu.Unlock()
+		return
+	}
+	if err != nil {
+		mc.failures++
+		mc.renewAt = m.clock().Now().Add(m.backoff(mc.failures))
+		mc.next = mc.renewAt
+	} else {
+		mc.cert, mc.renewAt, mc.next, mc.failures = cert, renewAt, renewAt, 0
+		mc.window = [2]time.Time{}
+		if t := m.clock().Now().Add(defaultRenewalInfoRetryAfter); m.renewalInfoSupported() && t.Before(mc.next) {
+			mc.next = t
+		}
+	}
+	renewAt = mc.renewAt
+	m.mu.Unlock()
+
+	if err != nil {
+		if m.OnFailure != nil {
+			m.OnFailure(name, err, renewAt)
+		}
+		return
+	}
+	if m.OnRenewed != nil {
+		m.OnRenewed(name, cert)
+	}
+	if storeErr != nil && m.OnFailure != nil {
+		m.OnFailure(name, fmt.Errorf("cupx/xacme.Manager: store certificate: %w", storeErr), renewAt)
+	}
+}
+
+func (m *Manager) issue(ctx context.Context, sr *IdlSignReq, opts ...Option) (*CertInfo, error) {
+	if m.Issue != nil {
+		return m.Issue(ctx, sr, opts...)
+	}
+	if m.Client == nil {
+		return nil, errors.New("cupx/xacme.Manager: no client")
+	}
+	return m.Client.SignCert(ctx, sr, opts...)
+}
+
+// renewalInfoSupported reports whether the CA publishes acme renewal information.
+func (m *Manager) renewalInfoSupported() bool {
+	return m.Client != nil && m.Client.Directory().RenewalInfo != ""
+}
+
+// renewalTime returns when cert is renewed, after RenewAfter of its lifetime plus jitter.
+func (m *Manager) renewalTime(cert *CertInfo) (time.Time, error) {
+	notBefore, notAfter, err := certValidity(cert)
+	if err != nil {
+		return time.Time{}, err
+	}
+	share := m.RenewAfter
+	if share <= 0 || share >= 1 {
+		share = defaultRenewAfter
+	}
+	renewAt := notBefore.Add(time.Duration(float64(notAfter.Sub(notBefore)) * share))
+	jitter := m.Jitter
+	if jitter == 0 {
+		jitter = defaultJitter
+	}
+	if jitter > 0 {
+		renewAt = renewAt.Add(time.Duration(rand.Int63n(int64(jitter))))
+	}
+	return renewAt, nil
+}
+
+// backoff returns the delay before retrying a renewal after failures failed renewals.
+func (m *Manager) backoff(failures int) time.Duration {
+	p := &RetryPolicy{MinBackoff: m.MinBackoff, MaxBackoff: m.MaxBackoff}
+	if p.MinBackoff <= 0 {
+		p.MinBackoff = defaultMinBackoff
+	}
+	if p.MaxBackoff <= 0 {
+		p.MaxBackoff = defaultMaxBackoff
+	}
+	if p.MaxBackoff < p.MinBackoff {
+		p.MaxBackoff = p.MinBackoff
+	}
+	return p.backoff(failures)
+}
+
+func (m *Manager) clock() Clock {
+	if m.Clock == nil {
+		return systemClock{}
+	}
+	return m.Clock
+}
+
+// notify wakes Run up to reschedule.
+func (m *Manager) notify() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.wake == nil {
+		m.wake = make(chan struct{}, 1)
+	}
+	select {
+	case m.wake <- struct{}{}:
+	default:
+	}
+}
+
+// certValidity returns the validity period of cert.
+func certValidity(cert *CertInfo) (notBefore time.Time, notAfter time.Time, err error) {
+	notBefore, err = time.Parse(time.RFC3339, cert.NotBefore)
+	if err != nil {
+		return notBefore, notAfter, fmt.Errorf("cupx/xacme: NotBefore of certificate: %w", err)
+	}
+	notAfter, err = time.Parse(time.RFC3339, cert.NotAfter)
+	if err != nil {
+		return notBefore, notAfter, fmt.Errorf("cupx/xacme: NotAfter of certificate: %w", err)
+	}
+	return notBefore, notAfter, nil
+}
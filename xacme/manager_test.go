@@ -0,0 +1,311 @@
+// Copyright 2020 The CupX Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xacme
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock is a Clock advanced by the test.
+type fakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+	// created counts the timers created.
+	created int
+}
+
+type fakeTimer struct {
+	clock *fakeClock
+	at    time.Time
+	c     chan time.Time
+}
+
+func (t *fakeTimer) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	for i, pending := range t.clock.timers {
+		if pending == t {
+			t.clock.timers = append(t.clock.timers[:i], t.clock.timers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Now()}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) NewTimer(d time.Duration) Timer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := &fakeTimer{clock: c, at: c.now.Add(d), c: make(chan time.Time, 1)}
+	c.timers = append(c.timers, t)
+	c.created++
+	c.fire()
+	return t
+}
+
+// Timers returns the number of timers created and of those neither fired nor stopped.
+func (c *fakeClock) Timers() (created int, pending int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.created, len(c.timers)
+}
+
+// AdvanceTo moves the time forward to t and fires the timers due.
+func (c *fakeClock) AdvanceTo(t time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = t
+	c.fire()
+}
+
+func (c *fakeClock) fire() {
+	var pending []*fakeTimer
+	for _, t := range c.timers {
+		if t.at.After(c.now) {
+			pending = append(pending, t)
+			continue
+		}
+		t.c <- c.now
+	}
+	c.timers = pending
+}
+
+func TestManager(t *testing.T) {
+	ca := newFakeCA(t)
+	fo := ca.enableOrders()
+	c := ca.newClient(WithSolver(ChallengeTypeDNS01, &recordSolver{}))
+
+	clock := newFakeClock()
+	renewed := make(chan *CertInfo, 1)
+	failed := make(chan time.Time, 1)
+	m := NewManager(c)
+	m.Clock = clock
+	m.Jitter = -1
+	m.Storage = NewMemStorage()
+	m.OnRenewed = func(name string, cert *CertInfo) {
+		renewed <- cert
+	}
+	m.OnFailure = func(name string, err error, retryAt time.Time) {
+		if !errors.Is(err, ErrBadCSR) {
+			t.Errorf("OnFailure() err = %v, want %v", err, ErrBadCSR)
+		}
+		failed <- retryAt
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- m.Run(ctx)
+	}()
+	sr := &IdlSignReq{Identifiers: []IdlIdentifier{{Type: "dns", Value: "manager.test.xdns.cupx.net"}}}
+	if err := m.Manage("manager", sr, nil); err != nil {
+		t.Fatal(err)
+	}
+	// the certificate is issued at once.
+	cert := <-renewed
+	if m.Certificate("manager") != cert {
+		t.Error("Certificate() is not the issued certificate")
+	}
+	if stored, err := LoadCert(context.Background(), m.Storage, CertName(sr.Identifiers)); err != nil || stored.PemCertBody != cert.PemCertBody {
+		t.Errorf("LoadCert() = %v, %v, want the issued certificate", stored, err)
+	}
+	notBefore, notAfter, err := certValidity(cert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := notBefore.Add(notAfter.Sub(notBefore) * 2 / 3)
+	renewAt, _ := m.RenewalTime("manager")
+	if renewAt.Sub(want) > time.Second || want.Sub(renewAt) > time.Second {
+		t.Errorf("RenewalTime() = %v, want %v", renewAt, want)
+	}
+
+	// a failed renewal is retried after the backoff.
+	fo.ca.mu.Lock()
+	fo.FinalizeProblem = "badCSR"
+	fo.ca.mu.Unlock()
+	clock.AdvanceTo(renewAt)
+	retryAt := <-failed
+	if backoff := retryAt.Sub(clock.Now()); backoff < m.MinBackoff/2 || backoff > m.MinBackoff {
+		t.Errorf("retry backoff = %v, want between %v and %v", backoff, m.MinBackoff/2, m.MinBackoff)
+	}
+
+	fo.ca.mu.Lock()
+	fo.FinalizeProblem = ""
+	fo.ca.mu.Unlock()
+	clock.AdvanceTo(retryAt)
+	if <-renewed == cert {
+		t.Error("certificate is not renewed")
+	}
+
+	m.Unmanage("manager")
+	if m.Certificate("manager") != nil {
+		t.Error("Certificate() after Unmanage != nil")
+	}
+
+	cancel()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Errorf("Run() err = %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestManager_renewalTime(t *testing.T) {
+	now := time.Now().UTC().Truncate(time.Second)
+	cert := &CertInfo{
+		NotBefore: now.Format(time.RFC3339),
+		NotAfter:  now.Add(90 * 24 * time.Hour).Format(time.RFC3339),
+	}
+	m := NewManager(nil)
+	m.RenewAfter = 0.5
+	for i := 0; i < 100; i++ {
+		renewAt, err := m.renewalTime(cert)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if d := renewAt.Sub(now); d < 45*24*time.Hour || d >= 45*24*time.Hour+m.Jitter {
+			t.Fatalf("renewalTime() = now + %v, want 45 days plus up to %v", d, m.Jitter)
+		}
+	}
+
+	if _, err := m.renewalTime(&CertInfo{NotBefore: "yesterday"}); err == nil {
+		t.Error("renewalTime() with invalid NotBefore err = nil")
+	}
+}
+
+func TestManager_zeroValue(t *testing.T) {
+	clock := newFakeClock()
+	failed := make(chan time.Time, 1)
+	m := &Manager{
+		Issue: func(ctx context.Context, sr *IdlSignReq, opts ...Option) (*CertInfo, error) {
+			return nil, ErrBadCSR
+		},
+		OnFailure: func(name string, err error, retryAt time.Time) {
+			failed <- retryAt
+		},
+		Clock: clock,
+	}
+
+	// a failed renewal is retried after the default backoff, not at once.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		_ = m.Run(ctx)
+	}()
+	if err := m.Manage("zero", &IdlSignReq{}, nil); err != nil {
+		t.Fatal(err)
+	}
+	retryAt := <-failed
+	if backoff := retryAt.Sub(clock.Now()); backoff < defaultMinBackoff/2 || backoff > defaultMinBackoff {
+		t.Errorf("retry backoff = %v, want between %v and %v", backoff, defaultMinBackoff/2, defaultMinBackoff)
+	}
+	for i := 2; i < 20; i++ {
+		if backoff := m.backoff(i); backoff > defaultMaxBackoff {
+			t.Fatalf("backoff(%d) = %v, want at most %v", i, backoff, defaultMaxBackoff)
+		}
+	}
+
+	now := time.Now().UTC().Truncate(time.Second)
+	cert := &CertInfo{
+		NotBefore: now.Format(time.RFC3339),
+		NotAfter:  now.Add(90 * 24 * time.Hour).Format(time.RFC3339),
+	}
+	renewAt, err := m.renewalTime(cert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := renewAt.Sub(now); d < 60*24*time.Hour || d >= 60*24*time.Hour+defaultJitter {
+		t.Errorf("renewalTime() = now + %v, want 60 days plus up to %v", d, defaultJitter)
+	}
+}
+
+func TestManager_ManageStored(t *testing.T) {
+	ca := newFakeCA(t)
+	ca.enableOrders()
+	c := ca.newClient(WithSolver(ChallengeTypeDNS01, &recordSolver{}))
+	ctx := context.Background()
+	sr := &IdlSignReq{Identifiers: []IdlIdentifier{{Type: "dns", Value: "stored.test.xdns.cupx.net"}}}
+	cert, err := c.SignCert(ctx, sr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := NewManager(c)
+	m.Storage = NewMemStorage()
+	if err := StoreCert(ctx, m.Storage, CertName(sr.Identifiers), cert); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.ManageStored(ctx, "stored", sr); err != nil {
+		t.Fatal(err)
+	}
+	if got := m.Certificate("stored"); got == nil || got.PemCertBody != cert.PemCertBody {
+		t.Errorf("Certificate() = %v, want the stored certificate", got)
+	}
+	newSr := &IdlSignReq{Identifiers: []IdlIdentifier{{Type: "dns", Value: "new.test.xdns.cupx.net"}}}
+	if err := m.ManageStored(ctx, "new", newSr); err != nil {
+		t.Fatal(err)
+	}
+	if got := m.Certificate("new"); got != nil {
+		t.Errorf("Certificate() = %v, want nil before issuance", got)
+	}
+}
+
+func TestManager_RunStopsTimers(t *testing.T) {
+	clock := newFakeClock()
+	m := NewManager(nil)
+	m.Clock = clock
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		_ = m.Run(ctx)
+	}()
+
+	now := time.Now().UTC().Truncate(time.Second)
+	cert := &CertInfo{
+		NotBefore: now.Format(time.RFC3339),
+		NotAfter:  now.Add(90 * 24 * time.Hour).Format(time.RFC3339),
+	}
+	// every change wakes Run, which waits on a new timer and stops the previous one.
+	for i := 0; i < 5; i++ {
+		before, _ := clock.Timers()
+		name := fmt.Sprintf("timer%d", i)
+		if err := m.Manage(name, &IdlSignReq{Identifiers: []IdlIdentifier{{Type: "dns", Value: name + ".test.xdns.cupx.net"}}}, cert); err != nil {
+			t.Fatal(err)
+		}
+		for created, _ := clock.Timers(); created == before; created, _ = clock.Timers() {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	if _, pending := clock.Timers(); pending != 1 {
+		t.Errorf("%d timers pending, want 1", pending)
+	}
+}
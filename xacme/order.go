@@ -0,0 +1,183 @@
+// Copyright 2020 The CupX Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xacme
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// Order statuses, see rfc8555 section 7.1.6.
+const (
+	OrderStatusPending    = "pending"
+	OrderStatusReady      = "ready"
+	OrderStatusProcessing = "processing"
+	OrderStatusValid      = "valid"
+	OrderStatusInvalid    = "invalid"
+)
+
+// maxOrderPolls bounds how often an order is polled without changing its status.
+const maxOrderPolls = 20
+
+// OrderError is returned when an order ends up invalid or does not make progress.
+type OrderError struct {
+	// URL is the order URL.
+	URL    string
+	Status string
+	// Problem is the error of the order, it is nil if the CA gave none.
+	Problem *ProblemError
+}
+
+func (e *OrderError) Error() string {
+	msg := "cupx/xacme: order " + e.URL + " is " + e.Status
+	if e.Problem != nil {
+		msg += ": " + e.Problem.Type + " " + e.Problem.Detail
+	}
+	return msg
+}
+
+// Unwrap returns the problem of the order, so that errors.Is matches its sentinel errors.
+func (e *OrderError) Unwrap() error {
+	if e.Problem == nil {
+		return nil
+	}
+	return e.Problem
+}
+
+// AuthorizationError is returned when the authorization of an identifier is not valid.
+type AuthorizationError struct {
+	// URL is the authorization URL.
+	URL        string
+	Identifier IdlIdentifier
+	Status     string
+	// Problem is the error of the failed challenge, it is nil if the CA gave none.
+	Problem *ProblemError
+}
+
+func (e *AuthorizationError) Error() string {
+	msg := "cupx/xacme: authorization of " + e.Identifier.Value + " is " + e.Status
+	if e.Problem != nil {
+		msg += ": " + e.Problem.Type + " " + e.Problem.Detail
+	}
+	return msg
+}
+
+// Unwrap returns the problem of the challenge, so that errors.Is matches its sentinel errors.
+func (e *AuthorizationError) Unwrap() error {
+	if e.Problem == nil {
+		return nil
+	}
+	return e.Problem
+}
+
+// newAuthorizationError returns the AuthorizationError of authz.
+func newAuthorizationError(url string, authz *IdlRespDownLoadAuthorizationResources) *AuthorizationError {
+	e := &AuthorizationError{URL: url, Identifier: authz.Identifier, Status: authz.Status}
+	for _, ch := range authz.Challenges {
+		if ch.Error != nil {
+			e.Problem = newProblemError(0, ch.Error)
+			break
+		}
+	}
+	return e
+}
+
+// getOrder fetches the order at url.
+func (c *client) getOrder(ctx context.Context, url string) (*IdlRespNewOrder, *http.Response, error) {
+
+	respb, resp, err := c.acmePost(ctx, url, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	o := &IdlRespNewOrder{}
+	err = json.Unmarshal(respb, o)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return o, resp, nil
+}
+
+// finishOrder drives the order at url from its status in o until it is valid, see rfc8555 section 7.1.6.
+// Pending authorizations are validated once, the csr is posted when the order is ready, and a
+// processing order is polled honoring Retry-After.
+func (c *client) finishOrder(ctx context.Context, url string, o *IdlRespNewOrder, csr []byte) (*IdlRespNewOrder, error) {
+
+	validated, finalized := false, false
+	polls := 0
+	var resp *http.Response
+	for {
+		status := o.Status
+		var err error
+		switch {
+		case status == OrderStatusValid:
+			if o.Certificate == "" {
+				return nil, errors.New("cupx/xacme.client.finishOrder: valid order without certificate URL")
+			}
+			return o, nil
+
+		case status == OrderStatusInvalid:
+			oerr := &OrderError{URL: url, Status: status}
+			if o.Error != nil {
+				oerr.Problem = newProblemError(0, o.Error)
+			}
+			return nil, oerr
+
+		case status == OrderStatusPending && !validated:
+			validated = true
+			err = c.validateIdentifier(ctx, o.Authorizations)
+			if err != nil {
+				return nil, err
+			}
+			o, resp, err = c.getOrder(ctx, url)
+
+		case status == OrderStatusReady && !finalized:
+			finalized = true
+			var respb []byte
+			respb, resp, err = c.acmePost(ctx, o.Finalize,
+				fmt.Sprintf("{\"csr\":\"%s\"}", base64.RawURLEncoding.EncodeToString(csr)))
+			if err != nil {
+				return nil, err
+			}
+			o = &IdlRespNewOrder{}
+			err = json.Unmarshal(respb, o)
+
+		case status == OrderStatusPending || status == OrderStatusReady || status == OrderStatusProcessing:
+			polls++
+			if polls > maxOrderPolls {
+				return nil, &OrderError{URL: url, Status: status}
+			}
+			err = sleepContext(ctx, c.opt.retryPolicy().pollInterval(resp))
+			if err != nil {
+				return nil, err
+			}
+			o, resp, err = c.getOrder(ctx, url)
+
+		default:
+			return nil, fmt.Errorf("cupx/xacme.client.finishOrder: unknown order status %q", status)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if o.Status != status {
+			polls = 0
+		}
+	}
+}
@@ -0,0 +1,107 @@
+// Copyright 2020 The CupX Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xacme
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestClient_finishOrder(t *testing.T) {
+	sr := &IdlSignReq{Identifiers: []IdlIdentifier{{Type: "dns", Value: "order.test.xdns.cupx.net"}}}
+	policy := WithRetryPolicy(RetryPolicy{PollInterval: time.Millisecond})
+
+	t.Run("processing", func(t *testing.T) {
+		ca := newFakeCA(t)
+		fo := ca.enableOrders()
+		fo.ProcessingPolls = 3
+		c := ca.newClient(WithSolver(ChallengeTypeDNS01, &recordSolver{}), policy)
+		ci, err := c.SignCert(context.Background(), sr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ci.PemCertBody == "" || fo.orders[0].Status != OrderStatusValid {
+			t.Errorf("SignCert() = %+v, order status = %v", ci, fo.orders[0].Status)
+		}
+	})
+
+	t.Run("retry after", func(t *testing.T) {
+		ca := newFakeCA(t)
+		fo := ca.enableOrders()
+		fo.ProcessingPolls, fo.RetryAfter = 1, "1"
+		c := ca.newClient(WithSolver(ChallengeTypeDNS01, &recordSolver{}), policy)
+		start := time.Now()
+		if _, err := c.SignCert(context.Background(), sr); err != nil {
+			t.Fatal(err)
+		}
+		if d := time.Since(start); d < time.Second {
+			t.Errorf("Retry-After of processing order not honored, took %v", d)
+		}
+	})
+
+	t.Run("invalid authorization", func(t *testing.T) {
+		ca := newFakeCA(t)
+		fo := ca.enableOrders()
+		fo.Validate = func(authz *fakeAuthz, ch *fakeChallenge) bool { return false }
+		c := ca.newClient(WithSolver(ChallengeTypeDNS01, &recordSolver{}), policy)
+		_, err := c.SignCert(context.Background(), sr)
+		var aerr *AuthorizationError
+		if !errors.As(err, &aerr) || aerr.Identifier.Value != "order.test.xdns.cupx.net" || aerr.Status != "invalid" {
+			t.Fatalf("SignCert() err = %v, want *AuthorizationError", err)
+		}
+		if !errors.Is(err, ErrIncorrectResponse) {
+			t.Errorf("errors.Is(%v, ErrIncorrectResponse) = false", err)
+		}
+	})
+
+	t.Run("finalize error", func(t *testing.T) {
+		ca := newFakeCA(t)
+		fo := ca.enableOrders()
+		fo.FinalizeProblem = "badCSR"
+		c := ca.newClient(WithSolver(ChallengeTypeDNS01, &recordSolver{}), policy)
+		if _, err := c.SignCert(context.Background(), sr); !errors.Is(err, ErrBadCSR) {
+			t.Errorf("SignCert() err = %v, want %v", err, ErrBadCSR)
+		}
+	})
+
+	t.Run("invalid order", func(t *testing.T) {
+		ca := newFakeCA(t)
+		fo := ca.enableOrders()
+		fo.ProcessingPolls, fo.InvalidAfterProcessing = 1, true
+		c := ca.newClient(WithSolver(ChallengeTypeDNS01, &recordSolver{}), policy)
+		_, err := c.SignCert(context.Background(), sr)
+		var oerr *OrderError
+		if !errors.As(err, &oerr) || oerr.Status != OrderStatusInvalid || oerr.URL != ca.url("/order/0") {
+			t.Fatalf("SignCert() err = %v, want *OrderError", err)
+		}
+		if !errors.Is(err, ErrServerInternal) {
+			t.Errorf("errors.Is(%v, ErrServerInternal) = false", err)
+		}
+	})
+
+	t.Run("stuck", func(t *testing.T) {
+		ca := newFakeCA(t)
+		fo := ca.enableOrders()
+		fo.ProcessingPolls = maxOrderPolls + 5
+		c := ca.newClient(WithSolver(ChallengeTypeDNS01, &recordSolver{}), policy)
+		_, err := c.SignCert(context.Background(), sr)
+		var oerr *OrderError
+		if !errors.As(err, &oerr) || oerr.Status != OrderStatusProcessing {
+			t.Errorf("SignCert() err = %v, want processing *OrderError", err)
+		}
+	})
+}
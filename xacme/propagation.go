@@ -0,0 +1,187 @@
+// Copyright 2020 The CupX Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xacme
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// ErrPropagationTimeout is returned when a TXT record is not visible on all authoritative
+// nameservers before the timeout.
+var ErrPropagationTimeout = errors.New("cupx/xacme: dns propagation timeout")
+
+// PropagationChecker waits until a TXT record is served by all authoritative nameservers of its zone.
+type PropagationChecker struct {
+	// Timeout bounds the wait, it defaults to 2 minutes.
+	Timeout time.Duration
+	// Interval is the interval of the checks, it defaults to 2 seconds.
+	Interval time.Duration
+	// Resolvers are the "host:port" addresses of the recursive resolvers used to find the
+	// authoritative nameservers, the system resolver is used if it is empty.
+	Resolvers []string
+	// NameserverPort is the port of the authoritative nameservers, it defaults to 53.
+	NameserverPort int
+}
+
+// queryTimeout bounds a single dns query.
+const queryTimeout = time.Second * 5
+
+// Wait polls the authoritative nameservers of fqdn until all of them serve value in a TXT record.
+func (p *PropagationChecker) Wait(ctx context.Context, fqdn string, value string) error {
+	timeout := p.Timeout
+	if timeout == 0 {
+		timeout = time.Minute * 2
+	}
+	interval := p.Interval
+	if interval == 0 {
+		interval = time.Second * 2
+	}
+	wctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var lastErr error
+	for {
+		ok, err := p.Check(wctx, fqdn, value)
+		if ok {
+			return nil
+		}
+		if err != nil {
+			lastErr = err
+		}
+		err = sleepContext(wctx, interval)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if lastErr == nil {
+				lastErr = errors.New("record not found")
+			}
+			return fmt.Errorf("%w: TXT %s: %v", ErrPropagationTimeout, fqdn, lastErr)
+		}
+	}
+}
+
+// Check reports whether all authoritative nameservers of fqdn serve value in a TXT record.
+func (p *PropagationChecker) Check(ctx context.Context, fqdn string, value string) (bool, error) {
+	fqdn = toFqdn(fqdn)
+	nameservers, err := p.Nameservers(ctx, fqdn)
+	if err != nil {
+		return false, err
+	}
+
+	for _, ns := range nameservers {
+		qctx, cancel := context.WithTimeout(ctx, queryTimeout)
+		txts, err := newResolver([]string{ns}).LookupTXT(qctx, fqdn)
+		cancel()
+		if err != nil {
+			return false, fmt.Errorf("nameserver %s: %v", ns, err)
+		}
+		if !containsString(txts, value) {
+			return false, fmt.Errorf("nameserver %s: value not found in %q", ns, txts)
+		}
+	}
+
+	return true, nil
+}
+
+// Nameservers returns the "ip:port" addresses of the authoritative nameservers of the zone of fqdn.
+func (p *PropagationChecker) Nameservers(ctx context.Context, fqdn string) ([]string, error) {
+	r := newResolver(p.Resolvers)
+	port := p.NameserverPort
+	if port == 0 {
+		port = 53
+	}
+
+	zone := toFqdn(fqdn)
+	for zone != "" && zone != "." {
+		qctx, cancel := context.WithTimeout(ctx, queryTimeout)
+		nss, err := r.LookupNS(qctx, zone)
+		cancel()
+		if err != nil && ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if len(nss) > 0 {
+			var addrs []string
+			for _, ns := range nss {
+				qctx, cancel := context.WithTimeout(ctx, queryTimeout)
+				ips, err := r.LookupIPAddr(qctx, ns.Host)
+				cancel()
+				if err != nil || len(ips) == 0 {
+					continue
+				}
+				addrs = append(addrs, net.JoinHostPort(preferIPv4(ips).String(), strconv.Itoa(port)))
+			}
+			if len(addrs) == 0 {
+				return nil, fmt.Errorf("cupx/xacme: no address found for the nameservers of %s", zone)
+			}
+			return addrs, nil
+		}
+
+		i := strings.Index(zone, ".")
+		zone = zone[i+1:]
+	}
+
+	return nil, fmt.Errorf("cupx/xacme: no authoritative nameserver found for %s", fqdn)
+}
+
+// newResolver returns a resolver querying servers, or the system resolver if servers is empty.
+func newResolver(servers []string) *net.Resolver {
+	if len(servers) == 0 {
+		return net.DefaultResolver
+	}
+	var next uint32
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			// rotate the servers, so that a retry asks another one.
+			server := servers[int(atomic.AddUint32(&next, 1)-1)%len(servers)]
+			var d net.Dialer
+			return d.DialContext(ctx, network, server)
+		},
+	}
+}
+
+// preferIPv4 returns the first IPv4 address of ips, or the first address if there is none.
+func preferIPv4(ips []net.IPAddr) net.IP {
+	for _, ip := range ips {
+		if ip.IP.To4() != nil {
+			return ip.IP
+		}
+	}
+	return ips[0].IP
+}
+
+func toFqdn(name string) string {
+	if strings.HasSuffix(name, ".") {
+		return name
+	}
+	return name + "."
+}
+
+func containsString(ss []string, s string) bool {
+	for _, v := range ss {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,275 @@
+// Copyright 2020 The CupX Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xacme
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	dnsTypeA     = 1
+	dnsTypeNS    = 2
+	dnsTypeCNAME = 5
+	dnsTypeTXT   = 16
+)
+
+type fakeRR struct {
+	Type  uint16
+	Value string
+}
+
+// fakeDNS is a minimal udp dns server answering A, NS, CNAME and TXT queries from its records.
+// It is authoritative and recursive at once, CNAMEs are followed within its records.
+type fakeDNS struct {
+	t       *testing.T
+	conn    net.PacketConn
+	mu      sync.Mutex
+	records map[string][]fakeRR
+	queries map[string]int
+}
+
+func newFakeDNS(t *testing.T) *fakeDNS {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := &fakeDNS{t: t, conn: conn, records: make(map[string][]fakeRR), queries: make(map[string]int)}
+	t.Cleanup(func() { _ = conn.Close() })
+	go d.serve()
+	return d
+}
+
+func (d *fakeDNS) addr() string {
+	return d.conn.LocalAddr().String()
+}
+
+func (d *fakeDNS) port() int {
+	return d.conn.LocalAddr().(*net.UDPAddr).Port
+}
+
+// checker returns a PropagationChecker resolving with d.
+func (d *fakeDNS) checker() *PropagationChecker {
+	return &PropagationChecker{
+		Timeout:        time.Second * 2,
+		Interval:       time.Millisecond * 10,
+		Resolvers:      []string{d.addr()},
+		NameserverPort: d.port(),
+	}
+}
+
+// zone adds a zone served by d at 127.0.0.1.
+func (d *fakeDNS) zone(zone string) {
+	d.add(zone, dnsTypeNS, "ns1."+zone)
+	d.add("ns1."+zone, dnsTypeA, "127.0.0.1")
+}
+
+func (d *fakeDNS) add(name string, typ uint16, value string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	name = strings.ToLower(toFqdn(name))
+	d.records[name] = append(d.records[name], fakeRR{Type: typ, Value: value})
+}
+
+func (d *fakeDNS) remove(name string, typ uint16, value string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	name = strings.ToLower(toFqdn(name))
+	rrs := d.records[name][:0]
+	for _, rr := range d.records[name] {
+		if rr.Type != typ || rr.Value != value {
+			rrs = append(rrs, rr)
+		}
+	}
+	d.records[name] = rrs
+	if len(rrs) == 0 {
+		delete(d.records, name)
+	}
+}
+
+func (d *fakeDNS) txt(name string) []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var values []string
+	for _, rr := range d.records[strings.ToLower(toFqdn(name))] {
+		if rr.Type == dnsTypeTXT {
+			values = append(values, rr.Value)
+		}
+	}
+	return values
+}
+
+func (d *fakeDNS) serve() {
+	buf := make([]byte, 1500)
+	for {
+		n, addr, err := d.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		if resp := d.answer(buf[:n]); resp != nil {
+			_, _ = d.conn.WriteTo(resp, addr)
+		}
+	}
+}
+
+func (d *fakeDNS) answer(q []byte) []byte {
+	if len(q) < 12 {
+		return nil
+	}
+	name, off, ok := readDNSName(q, 12)
+	if !ok || len(q) < off+4 {
+		return nil
+	}
+	qtype := binary.BigEndian.Uint16(q[off:])
+	question := q[12 : off+4]
+
+	d.mu.Lock()
+	d.queries[name]++
+	var answers [][]byte
+	rcode := uint16(0)
+	if _, found := d.records[name]; !found {
+		rcode = 3
+	}
+	for owner, hops := name, 0; hops < 8; hops++ {
+		var cname string
+		for _, rr := range d.records[owner] {
+			if rr.Type == qtype {
+				answers = append(answers, encodeDNSRR(owner, rr))
+			} else if rr.Type == dnsTypeCNAME {
+				answers = append(answers, encodeDNSRR(owner, rr))
+				cname = strings.ToLower(toFqdn(rr.Value))
+			}
+		}
+		if cname == "" || qtype == dnsTypeCNAME {
+			break
+		}
+		owner = cname
+	}
+	d.mu.Unlock()
+
+	resp := make([]byte, 12, 512)
+	copy(resp, q[:2])
+	// QR, AA, RD copied from the query, RA.
+	flags := uint16(0x8000|0x0400|0x0080) | binary.BigEndian.Uint16(q[2:])&0x0100 | rcode
+	binary.BigEndian.PutUint16(resp[2:], flags)
+	binary.BigEndian.PutUint16(resp[4:], 1)
+	binary.BigEndian.PutUint16(resp[6:], uint16(len(answers)))
+	resp = append(resp, question...)
+	for _, a := range answers {
+		resp = append(resp, a...)
+	}
+	return resp
+}
+
+func readDNSName(b []byte, off int) (string, int, bool) {
+	var labels []string
+	for {
+		if off >= len(b) {
+			return "", 0, false
+		}
+		l := int(b[off])
+		off++
+		if l == 0 {
+			break
+		}
+		if l > 63 || off+l > len(b) {
+			return "", 0, false
+		}
+		labels = append(labels, string(b[off:off+l]))
+		off += l
+	}
+	return strings.ToLower(strings.Join(labels, ".") + "."), off, true
+}
+
+func encodeDNSName(name string) []byte {
+	var b []byte
+	for _, l := range strings.Split(strings.TrimSuffix(toFqdn(name), "."), ".") {
+		b = append(b, byte(len(l)))
+		b = append(b, l...)
+	}
+	return append(b, 0)
+}
+
+func encodeDNSRR(owner string, rr fakeRR) []byte {
+	var rdata []byte
+	switch rr.Type {
+	case dnsTypeA:
+		rdata = net.ParseIP(rr.Value).To4()
+	case dnsTypeNS, dnsTypeCNAME:
+		rdata = encodeDNSName(rr.Value)
+	case dnsTypeTXT:
+		rdata = append([]byte{byte(len(rr.Value))}, rr.Value...)
+	}
+	b := encodeDNSName(owner)
+	hdr := make([]byte, 10)
+	binary.BigEndian.PutUint16(hdr, rr.Type)
+	binary.BigEndian.PutUint16(hdr[2:], 1)
+	binary.BigEndian.PutUint16(hdr[8:], uint16(len(rdata)))
+	b = append(b, hdr...)
+	return append(b, rdata...)
+}
+
+func TestPropagationChecker(t *testing.T) {
+	d := newFakeDNS(t)
+	d.zone("test.xdns.cupx.net")
+	p := d.checker()
+	ctx := context.Background()
+	name := "_acme-challenge.www.test.xdns.cupx.net"
+
+	nss, err := p.Nameservers(ctx, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nss) != 1 || nss[0] != d.addr() {
+		t.Errorf("Nameservers() = %v, want [%v]", nss, d.addr())
+	}
+
+	if ok, _ := p.Check(ctx, name, "value"); ok {
+		t.Error("Check() before the record is added = true")
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- p.Wait(ctx, name, "value")
+	}()
+	time.Sleep(time.Millisecond * 50)
+	d.add(name, dnsTypeTXT, "other")
+	time.Sleep(time.Millisecond * 50)
+	d.add(name, dnsTypeTXT, "value")
+	if err := <-done; err != nil {
+		t.Errorf("Wait() err = %v", err)
+	}
+
+	p.Timeout = time.Millisecond * 100
+	if err := p.Wait(ctx, name, "missing"); !errors.Is(err, ErrPropagationTimeout) {
+		t.Errorf("Wait() err = %v, want %v", err, ErrPropagationTimeout)
+	}
+
+	cctx, cancel := context.WithCancel(ctx)
+	cancel()
+	if err := p.Wait(cctx, name, "missing"); !errors.Is(err, context.Canceled) {
+		t.Errorf("Wait() canceled err = %v", err)
+	}
+
+	if _, err := p.Nameservers(ctx, "unknown.invalid"); err == nil {
+		t.Error("Nameservers() of unknown zone err = nil")
+	}
+}
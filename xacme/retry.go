@@ -0,0 +1,134 @@
+// Copyright 2020 The CupX Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xacme
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// RetryPolicy decides how requests to the acme server are retried and how often
+// authorizations and orders are polled.
+type RetryPolicy struct {
+	// MaxAttempts is the number of attempts of a request failing with a network error,
+	// 429 or 503, including the first one.
+	MaxAttempts int
+	// MinBackoff is the backoff after the first failed attempt, it doubles with every attempt.
+	// A random jitter of up to half the backoff is subtracted.
+	MinBackoff time.Duration
+	// MaxBackoff caps the backoff. A Retry-After longer than MaxBackoff is not waited for,
+	// the error is returned with ProblemError.RetryAfter set instead.
+	MaxBackoff time.Duration
+	// PollInterval is the interval polling authorizations and orders without Retry-After.
+	PollInterval time.Duration
+}
+
+// DefaultRetryPolicy is used unless WithRetryPolicy is set.
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts:  5,
+	MinBackoff:   time.Second,
+	MaxBackoff:   time.Minute * 2,
+	PollInterval: time.Second * 5,
+}
+
+// WithRetryPolicy sets the retry policy, zero fields are taken from DefaultRetryPolicy.
+func WithRetryPolicy(p RetryPolicy) Option {
+	return func(opt *option) {
+		if p.MaxAttempts == 0 {
+			p.MaxAttempts = DefaultRetryPolicy.MaxAttempts
+		}
+		if p.MinBackoff == 0 {
+			p.MinBackoff = DefaultRetryPolicy.MinBackoff
+		}
+		if p.MaxBackoff == 0 {
+			p.MaxBackoff = DefaultRetryPolicy.MaxBackoff
+		}
+		if p.PollInterval == 0 {
+			p.PollInterval = DefaultRetryPolicy.PollInterval
+		}
+		opt.retry = &p
+	}
+}
+
+// retryPolicy returns the retry policy of o.
+func (o *option) retryPolicy() *RetryPolicy {
+	if o.retry == nil {
+		return &DefaultRetryPolicy
+	}
+	return o.retry
+}
+
+// backoff returns the jittered backoff after attempt failed attempts.
+func (p *RetryPolicy) backoff(attempt int) time.Duration {
+	d := p.MinBackoff
+	for i := 1; i < attempt && d < p.MaxBackoff; i++ {
+		d *= 2
+	}
+	if d > p.MaxBackoff {
+		d = p.MaxBackoff
+	}
+	if d <= 1 {
+		return d
+	}
+	return d - time.Duration(rand.Int63n(int64(d/2)))
+}
+
+// pollInterval returns how long to wait before polling a resource again after resp.
+func (p *RetryPolicy) pollInterval(resp *http.Response) time.Duration {
+	if d := retryAfter(resp, time.Now()); d > 0 {
+		return d
+	}
+	return p.PollInterval
+}
+
+// retryAfter returns the Retry-After of resp, it is zero if there is none.
+// See rfc7231 section 7.1.3.
+func retryAfter(resp *http.Response, now time.Time) time.Duration {
+	if resp == nil {
+		return 0
+	}
+	v := resp.Header.Get("Retry-After")
+	if v == "" {
+		return 0
+	}
+	if sec, err := strconv.Atoi(v); err == nil {
+		if sec < 0 {
+			return 0
+		}
+		return time.Duration(sec) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil && t.After(now) {
+		return t.Sub(now)
+	}
+	return 0
+}
+
+// isTransient reports whether err of a request is worth retrying.
+func isTransient(ctx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	var nerr net.Error
+	if errors.As(err, &nerr) {
+		return true
+	}
+	return errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF)
+}
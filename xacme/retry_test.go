@@ -0,0 +1,157 @@
+// Copyright 2020 The CupX Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xacme
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestRetryAfter(t *testing.T) {
+	now := time.Date(2020, 11, 1, 8, 0, 0, 0, time.UTC)
+	tests := []struct {
+		value string
+		want  time.Duration
+	}{
+		{"", 0},
+		{"120", time.Minute * 2},
+		{"-1", 0},
+		{"Sun, 01 Nov 2020 08:00:30 GMT", time.Second * 30},
+		{"Sun, 01 Nov 2020 07:00:00 GMT", 0},
+		{"soon", 0},
+	}
+	for _, tt := range tests {
+		resp := &http.Response{Header: http.Header{}}
+		if tt.value != "" {
+			resp.Header.Set("Retry-After", tt.value)
+		}
+		if got := retryAfter(resp, now); got != tt.want {
+			t.Errorf("retryAfter(%q) = %v, want %v", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestRetryPolicy_backoff(t *testing.T) {
+	p := &RetryPolicy{MinBackoff: time.Second, MaxBackoff: time.Second * 10}
+	tests := []struct {
+		attempt int
+		max     time.Duration
+	}{
+		{1, time.Second},
+		{2, time.Second * 2},
+		{3, time.Second * 4},
+		{4, time.Second * 8},
+		{5, time.Second * 10},
+		{50, time.Second * 10},
+	}
+	for _, tt := range tests {
+		for i := 0; i < 10; i++ {
+			if d := p.backoff(tt.attempt); d > tt.max || d < tt.max/2 {
+				t.Errorf("backoff(%d) = %v, want in [%v, %v]", tt.attempt, d, tt.max/2, tt.max)
+			}
+		}
+	}
+}
+
+func TestClient_acmePostRetry(t *testing.T) {
+	ca := newFakeCA(t)
+	calls := 0
+	var fail func(w http.ResponseWriter) bool
+	ca.handle("/flaky", func(w http.ResponseWriter, r *fakeCAReq) {
+		calls++
+		if fail(w) {
+			return
+		}
+		_, _ = w.Write([]byte("{}"))
+	})
+	policy := RetryPolicy{MaxAttempts: 3, MinBackoff: time.Millisecond, MaxBackoff: time.Second * 2}
+	c := ca.newClient(WithRetryPolicy(policy))
+	ctx := context.Background()
+
+	tests := []struct {
+		name    string
+		fail    func(w http.ResponseWriter) bool
+		calls   int
+		wantErr error
+	}{
+		{"unavailable", func(w http.ResponseWriter) bool {
+			if calls < 3 {
+				ca.problem(w, http.StatusServiceUnavailable, "serverInternal", "maintenance")
+				return true
+			}
+			return false
+		}, 3, nil},
+		{"attempts exhausted", func(w http.ResponseWriter) bool {
+			ca.problem(w, http.StatusServiceUnavailable, "serverInternal", "maintenance")
+			return true
+		}, 3, ErrServerInternal},
+		{"retry after", func(w http.ResponseWriter) bool {
+			if calls < 2 {
+				w.Header().Set("Retry-After", "1")
+				ca.problem(w, http.StatusTooManyRequests, "rateLimited", "slow down")
+				return true
+			}
+			return false
+		}, 2, nil},
+		{"retry after too long", func(w http.ResponseWriter) bool {
+			w.Header().Set("Retry-After", "3600")
+			ca.problem(w, http.StatusTooManyRequests, "rateLimited", "too many certificates")
+			return true
+		}, 1, ErrRateLimited},
+		{"network error", func(w http.ResponseWriter) bool {
+			if calls < 2 {
+				panic(http.ErrAbortHandler)
+			}
+			return false
+		}, 2, nil},
+		{"not retried", func(w http.ResponseWriter) bool {
+			ca.problem(w, http.StatusInternalServerError, "serverInternal", "oops")
+			return true
+		}, 1, ErrServerInternal},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls, fail = 0, tt.fail
+			start := time.Now()
+			_, _, err := c.acmePost(ctx, ca.url("/flaky"), nil)
+			if !errors.Is(err, tt.wantErr) || (tt.wantErr == nil && err != nil) {
+				t.Errorf("acmePost() err = %v, want %v", err, tt.wantErr)
+			}
+			if calls != tt.calls {
+				t.Errorf("calls = %d, want %d", calls, tt.calls)
+			}
+			if tt.name == "retry after" && time.Since(start) < time.Second {
+				t.Errorf("Retry-After not honored, took %v", time.Since(start))
+			}
+			var perr *ProblemError
+			if tt.name == "retry after too long" && (!errors.As(err, &perr) || perr.RetryAfter != time.Hour) {
+				t.Errorf("RetryAfter of %v", err)
+			}
+		})
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	calls, fail = 0, func(w http.ResponseWriter) bool {
+		cancel()
+		ca.problem(w, http.StatusServiceUnavailable, "serverInternal", "maintenance")
+		return true
+	}
+	if _, _, err := c.acmePost(ctx, ca.url("/flaky"), nil); !errors.Is(err, context.Canceled) || calls != 1 {
+		t.Errorf("acmePost() canceled err = %v, calls = %d", err, calls)
+	}
+}
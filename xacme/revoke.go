@@ -0,0 +1,88 @@
+// Copyright 2020 The CupX Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xacme
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+
+	"gopkg.in/square/go-jose.v2"
+)
+
+// Revocation reason codes, see rfc5280 section 5.3.1.
+const (
+	RevocationReasonUnspecified          = 0
+	RevocationReasonKeyCompromise        = 1
+	RevocationReasonCACompromise         = 2
+	RevocationReasonAffiliationChanged   = 3
+	RevocationReasonSuperseded           = 4
+	RevocationReasonCessationOfOperation = 5
+	RevocationReasonCertificateHold      = 6
+	RevocationReasonRemoveFromCRL        = 8
+	RevocationReasonPrivilegeWithdrawn   = 9
+	RevocationReasonAACompromise         = 10
+)
+
+// WithRevocationKey signs the revocation request with the pem encoded private key of the
+// certificate instead of the account key, e.g. CertInfo.PemCertPrivateKey.
+func WithRevocationKey(pemKey string) Option {
+	return func(opt *option) {
+		opt.revocationKey = pemKey
+	}
+}
+
+func (c *client) RevokeCert(ctx context.Context, certPEM string, reason int, opts ...Option) error {
+
+	if reason < RevocationReasonUnspecified || reason > RevocationReasonAACompromise || reason == 7 {
+		return fmt.Errorf("cupx/xacme.client.RevokeCert: invalid reason code %d", reason)
+	}
+	if c.caMeta.RevokeCertURL == "" {
+		return errors.New("cupx/xacme.client.RevokeCert: the CA does not support revocation")
+	}
+
+	block, _ := pem.Decode([]byte(certPEM))
+	if block == nil || block.Type != "CERTIFICATE" {
+		return errors.New("cupx/xacme.client.RevokeCert: no certificate found")
+	}
+
+	nc := c.clone()
+	for _, opt := range opts {
+		opt(&nc.opt)
+	}
+
+	payload := &IdlReqRevokeCertPayload{
+		Certificate: base64.RawURLEncoding.EncodeToString(block.Bytes),
+		Reason:      reason,
+	}
+
+	sign := nc.signPayload
+	if nc.opt.revocationKey != "" {
+		key, err := ParsePemPrivateKey(nc.opt.revocationKey)
+		if err != nil {
+			return err
+		}
+		sign = func(nonce jose.NonceSource, url string, p interface{}) (string, error) {
+			return signPayloadWithKey(key, "", nonce, url, p)
+		}
+	} else if acct := nc.account(); acct == nil || acct.AcctURL == "" {
+		return errors.New("cupx/xacme.client.RevokeCert: account is not set")
+	}
+
+	_, _, err := nc.acmePostWithSigner(ctx, nc.caMeta.RevokeCertURL, payload, sign)
+	return err
+}
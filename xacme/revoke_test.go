@@ -0,0 +1,132 @@
+// Copyright 2020 The CupX Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xacme
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newTestCert returns a self-signed pem certificate and its pem private key.
+func newTestCert(t *testing.T, names ...string) (string, string) {
+	priKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:   big.NewInt(time.Now().UnixNano()),
+		Subject:        pkix.Name{CommonName: names[0]},
+		NotBefore:      time.Now().Add(-time.Hour),
+		NotAfter:       time.Now().Add(90 * 24 * time.Hour),
+		DNSNames:       names,
+		AuthorityKeyId: []byte{1, 2, 3, 4},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &priKey.PublicKey, priKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	priDer, err := x509.MarshalPKCS8PrivateKey(priKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+		string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: priDer}))
+}
+
+// certThumbprint returns the JWK thumbprint of the public key of a pem certificate.
+func certThumbprint(t *testing.T, certPEM string) string {
+	block, _ := pem.Decode([]byte(certPEM))
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tp, err := GetJWKThumbprintWithBase64url(cert.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tp
+}
+
+func TestClient_RevokeCert(t *testing.T) {
+	ca := newFakeCA(t)
+	certPEM, keyPEM := newTestCert(t, "revoke.test.xdns.cupx.net")
+	certPEM2, keyPEM2 := newTestCert(t, "revoke2.test.xdns.cupx.net")
+	certKeys := map[string]string{
+		certThumbprint(t, certPEM):  certPEM,
+		certThumbprint(t, certPEM2): certPEM2,
+	}
+
+	var mu sync.Mutex
+	revoked := make(map[string]bool)
+	ca.handle("/revoke-cert", func(w http.ResponseWriter, r *fakeCAReq) {
+		p := &IdlReqRevokeCertPayload{}
+		decodeJSON(t, r.Payload, p)
+		if p.Reason != RevocationReasonKeyCompromise {
+			t.Errorf("reason = %v", p.Reason)
+		}
+		der, _ := base64.RawURLEncoding.DecodeString(p.Certificate)
+		if r.JWK != nil {
+			// signed with a certificate key.
+			tp, _ := r.JWK.Thumbprint(crypto.SHA256)
+			certPEM, ok := certKeys[base64.RawURLEncoding.EncodeToString(tp)]
+			block, _ := pem.Decode([]byte(certPEM))
+			if !ok || string(block.Bytes) != string(der) {
+				ca.problem(w, http.StatusForbidden, "unauthorized", "key does not match certificate")
+				return
+			}
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if revoked[string(der)] {
+			ca.problem(w, http.StatusBadRequest, "alreadyRevoked", "certificate already revoked")
+			return
+		}
+		revoked[string(der)] = true
+	})
+
+	c := ca.newClient()
+
+	if err := c.RevokeCert(context.Background(), certPEM, 7); err == nil {
+		t.Error("RevokeCert() with reason 7 err = nil")
+	}
+	if err := c.RevokeCert(context.Background(), certPEM, RevocationReasonKeyCompromise); err != nil {
+		t.Fatal(err)
+	}
+	err := c.RevokeCert(context.Background(), certPEM, RevocationReasonKeyCompromise)
+	if !errors.Is(err, ErrAlreadyRevoked) {
+		t.Errorf("RevokeCert() twice err = %v, want %v", err, ErrAlreadyRevoked)
+	}
+
+	err = c.RevokeCert(context.Background(), certPEM2, RevocationReasonKeyCompromise, WithRevocationKey(keyPEM))
+	if !errors.Is(err, ErrUnauthorized) {
+		t.Errorf("RevokeCert() with other key err = %v, want %v", err, ErrUnauthorized)
+	}
+	if err := c.RevokeCert(context.Background(), certPEM2, RevocationReasonKeyCompromise, WithRevocationKey(keyPEM2)); err != nil {
+		t.Errorf("RevokeCert() with certificate key err = %v", err)
+	}
+}
@@ -0,0 +1,216 @@
+// Copyright 2020 The CupX Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xacme
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+const (
+	ChallengeTypeDNS01     = "dns-01"
+	ChallengeTypeHTTP01    = "http-01"
+	ChallengeTypeTLSALPN01 = "tls-alpn-01"
+)
+
+// Challenge is an acme challenge handed to a Solver.
+type Challenge struct {
+	Type       string
+	URL        string
+	Token      string
+	Identifier IdlIdentifier
+	// KeyAuthorization is the key authorization of Token, see rfc8555 section 8.1.
+	KeyAuthorization string
+}
+
+// Solver solves one type of acme challenge. The challenges of an order are all presented
+// before any is waited for, and cleaned up after all of them completed.
+type Solver interface {
+	// Present makes the challenge response available to the CA.
+	Present(ctx context.Context, ch *Challenge) error
+	// Wait blocks until the presented response can be validated by the CA or ctx is done.
+	Wait(ctx context.Context, ch *Challenge) error
+	// CleanUp removes what Present created. It is called whenever Present was called,
+	// with a context that is not canceled with the issuance.
+	CleanUp(ctx context.Context, ch *Challenge) error
+}
+
+type solverEntry struct {
+	identifier    string
+	challengeType string
+	solver        Solver
+}
+
+// WithSolver uses s to solve challenges of challengeType.
+func WithSolver(challengeType string, s Solver) Option {
+	return WithIdentifierSolver("", challengeType, s)
+}
+
+// WithIdentifierSolver uses s to solve challenges of challengeType for identifier only.
+// An empty identifier matches all identifiers.
+func WithIdentifierSolver(identifier string, challengeType string, s Solver) Option {
+	return func(opt *option) {
+		// copy on append, the slice may be shared with the client the option was cloned from.
+		opt.solvers = append(opt.solvers[:len(opt.solvers):len(opt.solvers)], solverEntry{
+			identifier:    canonicalIdentifier(identifier),
+			challengeType: challengeType,
+			solver:        s,
+		})
+	}
+}
+
+// solver returns the Solver of challengeType for identifier, later options take precedence
+// and identifier specific solvers take precedence over generic ones. A wildcard identifier
+// *.example.com falls back to the solvers of example.com.
+func (o *option) solver(identifier string, challengeType string) Solver {
+	identifier = canonicalIdentifier(identifier)
+	var base, generic Solver
+	for i := len(o.solvers) - 1; i >= 0; i-- {
+		e := o.solvers[i]
+		if e.challengeType != challengeType {
+			continue
+		}
+		if e.identifier == identifier {
+			return e.solver
+		}
+		if e.identifier != "" && "*."+e.identifier == identifier && base == nil {
+			base = e.solver
+		}
+		if e.identifier == "" && generic == nil {
+			generic = e.solver
+		}
+	}
+	if base != nil {
+		return base
+	}
+	return generic
+}
+
+// authzChallenge is the challenge of an authorization picked to be solved by solver.
+type authzChallenge struct {
+	authz  string
+	solver Solver
+	ch     *Challenge
+}
+
+// pickChallenge picks a Solver for one of the challenges offered by authz, in the order
+// the CA offers them. It returns nil if authz is no longer pending.
+func (c *client) pickChallenge(ctx context.Context, authz string) (*authzChallenge, error) {
+	darResp, _, err := c.downloadAuthorizationResources(ctx, authz)
+	if err != nil {
+		return nil, err
+	}
+	if darResp.Status != "pending" {
+		return nil, nil
+	}
+
+	// the identifier of a wildcard authorization is the domain without "*.", see rfc8555 section 7.1.4.
+	identifier := darResp.Identifier.Value
+	if darResp.Wildcard {
+		identifier = "*." + identifier
+	}
+
+	var offered []string
+	for _, challenge := range darResp.Challenges {
+		offered = append(offered, challenge.Type)
+		s := c.opt.solver(identifier, challenge.Type)
+		if s == nil {
+			continue
+		}
+
+		keyAuth, err := c.keyAuthorization(challenge.Token)
+		if err != nil {
+			return nil, err
+		}
+		return &authzChallenge{
+			authz:  authz,
+			solver: s,
+			ch: &Challenge{
+				Type:             challenge.Type,
+				URL:              challenge.URL,
+				Token:            challenge.Token,
+				Identifier:       darResp.Identifier,
+				KeyAuthorization: keyAuth,
+			},
+		}, nil
+	}
+
+	return nil, fmt.Errorf("cupx/xacme.client.pickChallenge: no solver for %s, offered challenges: %s",
+		identifier, strings.Join(offered, ","))
+}
+
+// solveChallenges solves the challenges of an order. All challenges are presented before
+// any is responded to and cleaned up only after every authorization completed, so that
+// authorizations sharing a record, e.g. the TXT record of example.com and *.example.com,
+// don't remove each other's response. The challenges are cleaned up on every return,
+// even if ctx is done, and cleanup errors are returned with the errors of solving.
+func (c *client) solveChallenges(ctx context.Context, acs []*authzChallenge) (err error) {
+	defer func() {
+		cctx, cancel := cleanupContext(ctx)
+		defer cancel()
+		err = joinErrors(err, forEach(len(acs), func(i int) error {
+			ch := acs[i].ch
+			if cerr := acs[i].solver.CleanUp(cctx, ch); cerr != nil {
+				return fmt.Errorf("cupx/xacme.client.solveChallenges: clean up %s challenge for %s: %w",
+					ch.Type, ch.Identifier.Value, cerr)
+			}
+			return nil
+		}))
+	}()
+
+	err = forEach(len(acs), func(i int) error {
+		return acs[i].solver.Present(ctx, acs[i].ch)
+	})
+	if err != nil {
+		return err
+	}
+
+	return forEach(len(acs), func(i int) error {
+		return c.solveChallenge(ctx, acs[i])
+	})
+}
+
+// solveChallenge waits for the presented challenge and responds to it, then waits until
+// the authorization is no longer pending.
+func (c *client) solveChallenge(ctx context.Context, ac *authzChallenge) error {
+	err := ac.solver.Wait(ctx, ac.ch)
+	if err != nil {
+		return err
+	}
+
+	_, _, err = c.acmePost(ctx, ac.ch.URL, "{}")
+	if err != nil {
+		return err
+	}
+
+	return c.waitAuthorization(ctx, ac.authz)
+}
+
+// forEach calls f for 0 to n-1 in parallel and returns their errors.
+func forEach(n int, f func(i int) error) error {
+	var wg sync.WaitGroup
+	errs := make([]error, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = f(i)
+		}(i)
+	}
+	wg.Wait()
+	return joinErrors(errs...)
+}
@@ -0,0 +1,169 @@
+// Copyright 2020 The CupX Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xacme
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestOption_solver(t *testing.T) {
+	dns1 := NewDNSSolver(nil, "")
+	dns2 := NewDNSSolver(nil, "cname.test.xdns.cupx.net")
+	http1 := NewHTTPSolver(NewMemHTTPChallengeStore())
+
+	base := option{}
+	WithSolver(ChallengeTypeDNS01, dns1)(&base)
+	o := base
+	WithIdentifierSolver("A.test.xdns.cupx.net", ChallengeTypeDNS01, dns2)(&o)
+	WithSolver(ChallengeTypeHTTP01, http1)(&o)
+	dns3 := NewDNSSolver(nil, "")
+	WithIdentifierSolver("*.c.test.xdns.cupx.net", ChallengeTypeDNS01, dns3)(&o)
+
+	tests := []struct {
+		name          string
+		opt           option
+		identifier    string
+		challengeType string
+		want          Solver
+	}{
+		{"generic", o, "b.test.xdns.cupx.net", ChallengeTypeDNS01, dns1},
+		{"identifier", o, "a.test.xdns.cupx.net", ChallengeTypeDNS01, dns2},
+		{"type", o, "a.test.xdns.cupx.net", ChallengeTypeHTTP01, http1},
+		{"missing", o, "a.test.xdns.cupx.net", ChallengeTypeTLSALPN01, nil},
+		{"wildcard", o, "*.c.test.xdns.cupx.net", ChallengeTypeDNS01, dns3},
+		{"wildcard not base", o, "c.test.xdns.cupx.net", ChallengeTypeDNS01, dns1},
+		{"wildcard of identifier", o, "*.a.test.xdns.cupx.net", ChallengeTypeDNS01, dns2},
+		{"base not modified", base, "a.test.xdns.cupx.net", ChallengeTypeDNS01, dns1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.opt.solver(tt.identifier, tt.challengeType); got != tt.want {
+				t.Errorf("solver() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// blockSolver blocks in Wait until ctx is done.
+type blockSolver struct {
+	recordSolver
+	waiting    chan struct{}
+	cleanupErr error
+}
+
+func (s *blockSolver) Wait(ctx context.Context, ch *Challenge) error {
+	close(s.waiting)
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func (s *blockSolver) CleanUp(ctx context.Context, ch *Challenge) error {
+	s.cleanupErr = ctx.Err()
+	return s.recordSolver.CleanUp(ctx, ch)
+}
+
+func TestClient_SignCertCanceled(t *testing.T) {
+	ca := newFakeCA(t)
+	ca.enableOrders()
+	s := &blockSolver{waiting: make(chan struct{})}
+	c := ca.newClient(WithSolver(ChallengeTypeDNS01, s))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-s.waiting
+		cancel()
+	}()
+	_, err := c.SignCert(ctx, &IdlSignReq{Identifiers: []IdlIdentifier{{Type: "dns", Value: "cancel.test.xdns.cupx.net"}}})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("SignCert() err = %v, want %v", err, context.Canceled)
+	}
+	if len(s.presents) != 1 || len(s.cleanups) != 1 {
+		t.Errorf("presents = %d, cleanups = %d", len(s.presents), len(s.cleanups))
+	}
+	if s.cleanupErr != nil {
+		t.Errorf("CleanUp() ctx err = %v", s.cleanupErr)
+	}
+}
+
+// failSolver fails Present for the identifiers in presentErrs and every CleanUp.
+type failSolver struct {
+	recordSolver
+	presentErrs map[string]error
+	cleanupErr  error
+}
+
+func (s *failSolver) Present(ctx context.Context, ch *Challenge) error {
+	_ = s.recordSolver.Present(ctx, ch)
+	return s.presentErrs[ch.Identifier.Value]
+}
+
+func (s *failSolver) CleanUp(ctx context.Context, ch *Challenge) error {
+	_ = s.recordSolver.CleanUp(ctx, ch)
+	return s.cleanupErr
+}
+
+func TestClient_SignCertCleanUpErrors(t *testing.T) {
+	ca := newFakeCA(t)
+	ca.enableOrders()
+	errPresent := errors.New("present failed")
+	errCleanUp := errors.New("cleanup failed")
+	s := &failSolver{
+		presentErrs: map[string]error{"a.test.xdns.cupx.net": errPresent},
+		cleanupErr:  errCleanUp,
+	}
+	c := ca.newClient(WithSolver(ChallengeTypeDNS01, s))
+
+	_, err := c.SignCert(context.Background(), &IdlSignReq{Identifiers: []IdlIdentifier{
+		{Type: "dns", Value: "a.test.xdns.cupx.net"},
+		{Type: "dns", Value: "b.test.xdns.cupx.net"},
+	}})
+	if !errors.Is(err, errPresent) || !errors.Is(err, errCleanUp) {
+		t.Errorf("SignCert() err = %v, want %v and %v", err, errPresent, errCleanUp)
+	}
+	var me MultiError
+	if !errors.As(err, &me) || len(me) != 3 {
+		t.Errorf("SignCert() err = %#v, want 3 errors", err)
+	}
+	if len(s.presents) != 2 || len(s.cleanups) != 2 {
+		t.Errorf("presents = %d, cleanups = %d", len(s.presents), len(s.cleanups))
+	}
+}
+
+func TestClient_SignCertWildcardSolver(t *testing.T) {
+	ca := newFakeCA(t)
+	ca.enableOrders()
+	dns, http := &recordSolver{}, &recordSolver{}
+	c := ca.newClient(
+		WithIdentifierSolver("*.wild.test.xdns.cupx.net", ChallengeTypeDNS01, dns),
+		WithIdentifierSolver("wild.test.xdns.cupx.net", ChallengeTypeHTTP01, http),
+	)
+
+	// the wildcard authorization is for wild.test.xdns.cupx.net with wildcard set.
+	_, err := c.SignCert(context.Background(), &IdlSignReq{Identifiers: []IdlIdentifier{
+		{Type: "dns", Value: "wild.test.xdns.cupx.net"},
+		{Type: "dns", Value: "*.wild.test.xdns.cupx.net"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dns.presents) != 1 || dns.presents[0].Type != ChallengeTypeDNS01 {
+		t.Errorf("dns-01 solver presents = %v, want the wildcard challenge", dns.presents)
+	}
+	if len(http.presents) != 1 || http.presents[0].Identifier.Value != "wild.test.xdns.cupx.net" {
+		t.Errorf("http-01 solver presents = %v, want the challenge of the domain", http.presents)
+	}
+}
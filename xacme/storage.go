@@ -0,0 +1,439 @@
+// Copyright 2020 The CupX Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xacme
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Storage persists accounts and certificates. Keys are slash separated paths,
+// e.g. live/example.com/fullchain.pem.
+type Storage interface {
+	// Load returns the value of key, or an error matching os.ErrNotExist if it is not stored.
+	Load(ctx context.Context, key string) ([]byte, error)
+	// Store stores value under key, replacing the previous value.
+	Store(ctx context.Context, key string, value []byte) error
+	// Delete deletes key and the keys under it, it doesn't fail if key is not stored.
+	Delete(ctx context.Context, key string) error
+	// List returns the keys under prefix in lexical order.
+	List(ctx context.Context, prefix string) ([]string, error)
+	// Lock acquires the lock of name, waiting until it is released or ctx is done.
+	// The returned func releases the lock.
+	Lock(ctx context.Context, name string) (unlock func() error, err error)
+}
+
+// Files of a certificate under live/<name>/, in the layout of certbot.
+const (
+	storageCertFile      = "cert.pem"
+	storageChainFile     = "chain.pem"
+	storageFullChainFile = "fullchain.pem"
+	storagePrivKeyFile   = "privkey.pem"
+)
+
+// CertName returns the name certificates of identifiers are stored under,
+// the first identifier with a wildcard replaced by an underscore.
+func CertName(identifiers []IdlIdentifier) string {
+	if len(identifiers) == 0 {
+		return ""
+	}
+	return strings.Replace(strings.ToLower(identifiers[0].Value), "*", "_", 1)
+}
+
+// StoreCert stores cert under live/<name>/ in the layout of certbot: cert.pem, chain.pem,
+// fullchain.pem and privkey.pem. The files of cert left empty, e.g. privkey.pem of a
+// certificate whose key is not generated by xacme, are deleted so that no stale file is
+// paired with the new certificate.
+func StoreCert(ctx context.Context, s Storage, name string, cert *CertInfo) error {
+	if err := checkStorageName(name); err != nil {
+		return err
+	}
+	unlock, err := s.Lock(ctx, "live/"+name)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	files := []struct {
+		name  string
+		value string
+	}{
+		{storagePrivKeyFile, cert.PemCertPrivateKey},
+		{storageCertFile, cert.PemCertBody},
+		{storageChainFile, cert.PemCertChain},
+		{storageFullChainFile, cert.PemCertBodyWithChain},
+	}
+	for _, f := range files {
+		key := path.Join("live", name, f.name)
+		if f.value == "" {
+			if err := s.Delete(ctx, key); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := s.Store(ctx, key, []byte(f.value)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadCertRetries is how many times LoadCert reads a certificate again whose private key
+// doesn't match, as StoreCert may be replacing the files.
+const loadCertRetries = 5
+
+// loadCertRetryDelay is the delay before LoadCert reads a certificate again.
+const loadCertRetryDelay = time.Millisecond * 100
+
+// LoadCert loads the certificate stored under live/<name>/ by StoreCert.
+// It doesn't wait for the lock of StoreCert, so that a lock left by a crashed process
+// doesn't block the readers. Instead, a private key not matching the certificate, read
+// while the files are replaced, is read again until it matches.
+// It returns an error matching os.ErrNotExist if there is none.
+func LoadCert(ctx context.Context, s Storage, name string) (*CertInfo, error) {
+	if err := checkStorageName(name); err != nil {
+		return nil, err
+	}
+	for i := 0; ; i++ {
+		cert, err := readCert(ctx, s, name)
+		if err != nil || cert.PemCertPrivateKey == "" {
+			return cert, err
+		}
+		_, err = tls.X509KeyPair([]byte(cert.PemCertBodyWithChain), []byte(cert.PemCertPrivateKey))
+		if err == nil {
+			return cert, nil
+		}
+		if i == loadCertRetries {
+			return nil, fmt.Errorf("cupx/xacme.LoadCert: %s: %w", path.Join("live", name), err)
+		}
+		if err := sleepContext(ctx, loadCertRetryDelay); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// readCert reads the files of the certificate stored under live/<name>/.
+func readCert(ctx context.Context, s Storage, name string) (*CertInfo, error) {
+	fullchain, err := s.Load(ctx, path.Join("live", name, storageFullChainFile))
+	if err != nil {
+		return nil, err
+	}
+	privkey, err := s.Load(ctx, path.Join("live", name, storagePrivKeyFile))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	cert := newCertInfo(fullchain, string(privkey))
+	if cert == nil {
+		return nil, fmt.Errorf("cupx/xacme.LoadCert: no certificate found in %s", path.Join("live", name, storageFullChainFile))
+	}
+	return cert, nil
+}
+
+// DeleteCert deletes the certificate stored under live/<name>/.
+func DeleteCert(ctx context.Context, s Storage, name string) error {
+	if err := checkStorageName(name); err != nil {
+		return err
+	}
+	return s.Delete(ctx, path.Join("live", name))
+}
+
+// ListCerts returns the names of the stored certificates.
+func ListCerts(ctx context.Context, s Storage) ([]string, error) {
+	keys, err := s.List(ctx, "live")
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, key := range keys {
+		if path.Base(key) != storageFullChainFile {
+			continue
+		}
+		names = append(names, path.Base(path.Dir(key)))
+	}
+	return names, nil
+}
+
+// StoreAccount stores acct under accounts/<name>.json with its pem encoded private key.
+func StoreAccount(ctx context.Context, s Storage, name string, acct *Account) error {
+	if err := checkStorageName(name); err != nil {
+		return err
+	}
+	a := *acct
+	if a.PemPrivateKey == "" && a.PrivateKey != nil {
+		pemKey, err := MarshalPemPrivateKey(a.PrivateKey)
+		if err != nil {
+			return err
+		}
+		a.PemPrivateKey = pemKey
+	}
+	a.PrivateKey = nil
+	b, err := json.Marshal(&a)
+	if err != nil {
+		return err
+	}
+	return s.Store(ctx, "accounts/"+name+".json", b)
+}
+
+// LoadAccount loads the account stored under accounts/<name>.json by StoreAccount, it can be
+// passed to Client.SetAccount. It returns an error matching os.ErrNotExist if there is none.
+func LoadAccount(ctx context.Context, s Storage, name string) (*Account, error) {
+	if err := checkStorageName(name); err != nil {
+		return nil, err
+	}
+	b, err := s.Load(ctx, "accounts/"+name+".json")
+	if err != nil {
+		return nil, err
+	}
+	acct := &Account{}
+	if err := json.Unmarshal(b, acct); err != nil {
+		return nil, err
+	}
+	if acct.PemPrivateKey != "" {
+		acct.PrivateKey, err = ParsePemPrivateKey(acct.PemPrivateKey)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return acct, nil
+}
+
+// WithStorage stores the certificates issued by the client in s under their CertName.
+// If storing fails, the issued certificate is returned along with the error.
+func WithStorage(s Storage) Option {
+	return func(opt *option) {
+		opt.storage = s
+	}
+}
+
+// checkStorageName checks that name is a single path element.
+func checkStorageName(name string) error {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+		return fmt.Errorf("cupx/xacme: invalid storage name %q", name)
+	}
+	return nil
+}
+
+// cleanStorageKey returns key without leading, trailing and repeated slashes and dot elements.
+func cleanStorageKey(key string) string {
+	return strings.TrimPrefix(path.Clean("/"+key), "/")
+}
+
+// FileStorage stores the keys as files under Dir. Values are written atomically with
+// 0600 permissions, and locks are files under Dir/locks which are taken over when stale.
+type FileStorage struct {
+	Dir string
+}
+
+// NewFileStorage returns FileStorage storing files under dir.
+func NewFileStorage(dir string) *FileStorage {
+	return &FileStorage{Dir: dir}
+}
+
+// fileLockPoll is the interval checking if a file lock is released.
+const fileLockPoll = time.Millisecond * 100
+
+// staleFileLock is the age after which a file lock is considered left by a crashed process.
+const staleFileLock = time.Hour
+
+func (s *FileStorage) filename(key string) string {
+	return filepath.Join(s.Dir, filepath.FromSlash(cleanStorageKey(key)))
+}
+
+func (s *FileStorage) Load(ctx context.Context, key string) ([]byte, error) {
+	return ioutil.ReadFile(s.filename(key))
+}
+
+// Store writes value to a temporary file which replaces the file of key,
+// so that readers see either the previous or the new value.
+func (s *FileStorage) Store(ctx context.Context, key string, value []byte) error {
+	filename := s.filename(key)
+	dir := filepath.Dir(filename)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(dir, "."+filepath.Base(filename)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	_, err = f.Write(value)
+	if err == nil {
+		err = f.Chmod(0600)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), filename)
+}
+
+func (s *FileStorage) Delete(ctx context.Context, key string) error {
+	return os.RemoveAll(s.filename(key))
+}
+
+func (s *FileStorage) List(ctx context.Context, prefix string) ([]string, error) {
+	root := s.filename(prefix)
+	var keys []string
+	err := filepath.Walk(root, func(name string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && name == root {
+				return nil
+			}
+			return err
+		}
+		if info.IsDir() && name == filepath.Join(s.Dir, "locks") {
+			return filepath.SkipDir
+		}
+		if info.IsDir() || strings.HasPrefix(info.Name(), ".") {
+			return nil
+		}
+		rel, err := filepath.Rel(s.Dir, name)
+		if err != nil {
+			return err
+		}
+		keys = append(keys, filepath.ToSlash(rel))
+		return nil
+	})
+	return keys, err
+}
+
+func (s *FileStorage) Lock(ctx context.Context, name string) (func() error, error) {
+	filename := s.filename(path.Join("locks", name+".lock"))
+	if err := os.MkdirAll(filepath.Dir(filename), 0700); err != nil {
+		return nil, err
+	}
+	for {
+		f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err == nil {
+			_ = f.Close()
+			return func() error {
+				return os.Remove(filename)
+			}, nil
+		}
+		if !os.IsExist(err) {
+			return nil, err
+		}
+		if info, err := os.Stat(filename); err == nil && time.Since(info.ModTime()) > staleFileLock {
+			_ = os.Remove(filename)
+			continue
+		}
+		if err := sleepContext(ctx, fileLockPoll); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// MemStorage stores the keys in memory, e.g. for tests.
+type MemStorage struct {
+	mu     sync.Mutex
+	values map[string][]byte
+	locks  map[string]chan struct{}
+}
+
+// NewMemStorage returns MemStorage.
+func NewMemStorage() *MemStorage {
+	return &MemStorage{
+		values: make(map[string][]byte),
+		locks:  make(map[string]chan struct{}),
+	}
+}
+
+func (s *MemStorage) Load(ctx context.Context, key string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	value, ok := s.values[cleanStorageKey(key)]
+	if !ok {
+		return nil, fmt.Errorf("cupx/xacme.MemStorage: %s: %w", key, os.ErrNotExist)
+	}
+	return append([]byte(nil), value...), nil
+}
+
+func (s *MemStorage) Store(ctx context.Context, key string, value []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.values[cleanStorageKey(key)] = append([]byte(nil), value...)
+	return nil
+}
+
+func (s *MemStorage) Delete(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key = cleanStorageKey(key)
+	for k := range s.values {
+		if k == key || strings.HasPrefix(k, key+"/") {
+			delete(s.values, k)
+		}
+	}
+	return nil
+}
+
+func (s *MemStorage) List(ctx context.Context, prefix string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	prefix = cleanStorageKey(prefix)
+	var keys []string
+	for k := range s.values {
+		if prefix == "" || k == prefix || strings.HasPrefix(k, prefix+"/") {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+func (s *MemStorage) Lock(ctx context.Context, name string) (func() error, error) {
+	for {
+		s.mu.Lock()
+		held, ok := s.locks[name]
+		if !ok {
+			released := make(chan struct{})
+			s.locks[name] = released
+			s.mu.Unlock()
+			return func() error {
+				s.mu.Lock()
+				defer s.mu.Unlock()
+				if s.locks[name] == released {
+					delete(s.locks, name)
+					close(released)
+				}
+				return nil
+			}, nil
+		}
+		s.mu.Unlock()
+
+		select {
+		case <-held:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,263 @@
+// Copyright 2020 The CupX Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xacme
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "xacme")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = os.RemoveAll(dir)
+	})
+	return dir
+}
+
+func TestStorage(t *testing.T) {
+	tests := []struct {
+		name string
+		s    Storage
+	}{
+		{"file", NewFileStorage(tempDir(t))},
+		{"mem", NewMemStorage()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			s := tt.s
+			if _, err := s.Load(ctx, "live/a/cert.pem"); !errors.Is(err, os.ErrNotExist) {
+				t.Errorf("Load() err = %v, want %v", err, os.ErrNotExist)
+			}
+			for _, key := range []string{"live/a/cert.pem", "live/a/privkey.pem", "live/b/cert.pem", "accounts/x.json"} {
+				if err := s.Store(ctx, key, []byte(key)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := s.Store(ctx, "/live//a/cert.pem", []byte("replaced")); err != nil {
+				t.Fatal(err)
+			}
+			if v, err := s.Load(ctx, "live/a/cert.pem"); err != nil || string(v) != "replaced" {
+				t.Errorf("Load() = %q, %v", v, err)
+			}
+
+			keys, err := s.List(ctx, "live")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := []string{"live/a/cert.pem", "live/a/privkey.pem", "live/b/cert.pem"}; !reflect.DeepEqual(keys, want) {
+				t.Errorf("List() = %v, want %v", keys, want)
+			}
+			if keys, err := s.List(ctx, "none"); err != nil || len(keys) != 0 {
+				t.Errorf("List() of missing prefix = %v, %v", keys, err)
+			}
+
+			if err := s.Delete(ctx, "live/a"); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.Delete(ctx, "live/a"); err != nil {
+				t.Errorf("Delete() of deleted key err = %v", err)
+			}
+			if keys, _ := s.List(ctx, ""); !reflect.DeepEqual(keys, []string{"accounts/x.json", "live/b/cert.pem"}) {
+				t.Errorf("List() after Delete() = %v", keys)
+			}
+
+			unlock, err := s.Lock(ctx, "live/b")
+			if err != nil {
+				t.Fatal(err)
+			}
+			tctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+			defer cancel()
+			if _, err := s.Lock(tctx, "live/b"); !errors.Is(err, context.DeadlineExceeded) {
+				t.Errorf("Lock() of held lock err = %v, want %v", err, context.DeadlineExceeded)
+			}
+			locked := make(chan struct{})
+			go func() {
+				unlock2, err := s.Lock(ctx, "live/b")
+				if err == nil {
+					_ = unlock2()
+				}
+				close(locked)
+			}()
+			if err := unlock(); err != nil {
+				t.Fatal(err)
+			}
+			select {
+			case <-locked:
+			case <-time.After(5 * time.Second):
+				t.Error("Lock() is not acquired after unlock")
+			}
+		})
+	}
+}
+
+func TestFileStorage_files(t *testing.T) {
+	dir := tempDir(t)
+	s := NewFileStorage(dir)
+	ctx := context.Background()
+	if err := s.Store(ctx, "live/a/privkey.pem", []byte("key")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Store(ctx, "../escape", []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Stat(filepath.Join(dir, "live", "a", "privkey.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm != 0600 {
+		t.Errorf("permissions = %v, want 0600", perm)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "escape")); err != nil {
+		t.Errorf("key escaped Dir: %v", err)
+	}
+	files, _ := ioutil.ReadDir(filepath.Join(dir, "live", "a"))
+	if len(files) != 1 {
+		t.Errorf("files = %v, want only privkey.pem", files)
+	}
+}
+
+func TestStoreCert(t *testing.T) {
+	ca := newFakeCA(t)
+	ca.enableOrders()
+	s := NewFileStorage(tempDir(t))
+	c := ca.newClient(WithSolver(ChallengeTypeDNS01, &recordSolver{}), WithStorage(s))
+	ctx := context.Background()
+
+	sr := &IdlSignReq{Identifiers: []IdlIdentifier{
+		{Type: "dns", Value: "*.storage.test.xdns.cupx.net"},
+		{Type: "dns", Value: "storage.test.xdns.cupx.net"},
+	}}
+	cert, err := c.SignCert(ctx, sr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	name := CertName(sr.Identifiers)
+	if name != "_.storage.test.xdns.cupx.net" {
+		t.Errorf("CertName() = %v", name)
+	}
+	for _, file := range []string{"cert.pem", "chain.pem", "fullchain.pem", "privkey.pem"} {
+		if _, err := os.Stat(filepath.Join(s.Dir, "live", name, file)); err != nil {
+			t.Error(err)
+		}
+	}
+	stored, err := LoadCert(ctx, s, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(stored, cert) {
+		t.Errorf("LoadCert() = %+v, want %+v", stored, cert)
+	}
+	if names, err := ListCerts(ctx, s); err != nil || !reflect.DeepEqual(names, []string{name}) {
+		t.Errorf("ListCerts() = %v, %v", names, err)
+	}
+
+	// the key of the previous certificate is not left next to a certificate without key.
+	noKey := *cert
+	noKey.PemCertPrivateKey = ""
+	if err := StoreCert(ctx, s, name, &noKey); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(s.Dir, "live", name, "privkey.pem")); !os.IsNotExist(err) {
+		t.Errorf("privkey.pem of the previous certificate is left, err = %v", err)
+	}
+	if stored, err := LoadCert(ctx, s, name); err != nil || stored.PemCertPrivateKey != "" {
+		t.Errorf("LoadCert() = %+v, %v, want no private key", stored, err)
+	}
+
+	// a lock left by a crashed process doesn't block the readers, which don't return
+	// a private key of another certificate.
+	if err := StoreCert(ctx, s, name, cert); err != nil {
+		t.Fatal(err)
+	}
+	unlock, err := s.Lock(ctx, "live/"+name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, otherKey := newTestCert(t, "other.storage.test.xdns.cupx.net")
+	if err := s.Store(ctx, "live/"+name+"/privkey.pem", []byte(otherKey)); err != nil {
+		t.Fatal(err)
+	}
+	if stored, err := LoadCert(ctx, s, name); err == nil {
+		t.Errorf("LoadCert() with the key of another certificate = %+v, want an error", stored)
+	}
+	if err := s.Store(ctx, "live/"+name+"/privkey.pem", []byte(cert.PemCertPrivateKey)); err != nil {
+		t.Fatal(err)
+	}
+	if stored, err := LoadCert(ctx, s, name); err != nil || !reflect.DeepEqual(stored, cert) {
+		t.Errorf("LoadCert() while locked = %+v, %v, want %+v", stored, err, cert)
+	}
+	if err := unlock(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := DeleteCert(ctx, s, name); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadCert(ctx, s, name); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("LoadCert() after DeleteCert() err = %v, want %v", err, os.ErrNotExist)
+	}
+	if err := StoreCert(ctx, s, "../x", cert); err == nil {
+		t.Error("StoreCert() with invalid name err = nil")
+	}
+}
+
+func TestStoreAccount(t *testing.T) {
+	ca := newFakeCA(t)
+	ca.enableOrders()
+	acct := ca.newClient().acct
+	s := NewMemStorage()
+	ctx := context.Background()
+
+	if err := StoreAccount(ctx, s, "fake", acct); err != nil {
+		t.Fatal(err)
+	}
+	stored, err := LoadAccount(ctx, s, "fake")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.AcctURL != acct.AcctURL || stored.PemPrivateKey != acct.PemPrivateKey || stored.PrivateKey == nil {
+		t.Errorf("LoadAccount() = %+v", stored)
+	}
+
+	// the stored account signs the requests of another client.
+	c, err := NewClient(ctx, &Config{DirURL: ca.url("/dir")}, WithSolver(ChallengeTypeDNS01, &recordSolver{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.SetAccount(stored); err != nil {
+		t.Fatal(err)
+	}
+	sr := &IdlSignReq{Identifiers: []IdlIdentifier{{Type: "dns", Value: "account.test.xdns.cupx.net"}}}
+	if _, err := c.SignCert(ctx, sr); err != nil {
+		t.Error(err)
+	}
+
+	if _, err := LoadAccount(ctx, s, "none"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("LoadAccount() err = %v, want %v", err, os.ErrNotExist)
+	}
+}
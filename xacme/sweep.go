@@ -0,0 +1,85 @@
+// Copyright 2020 The CupX Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xacme
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"cupx.github.io/pkg/xdns"
+)
+
+// ErrRecordListingUnsupported is returned by SweepChallengeRecords if the xdns.XDns
+// doesn't implement xdns.RecordLister.
+var ErrRecordListingUnsupported = errors.New("cupx/xacme: dns doesn't support listing records")
+
+// ErrRecordAgeUnknown is returned by SweepChallengeRecords for the records it cannot tell
+// the age of, they are kept unless olderThan is 0.
+var ErrRecordAgeUnknown = errors.New("cupx/xacme: age of record unknown")
+
+// SweepChallengeRecords deletes the _acme-challenge TXT records left in zone, e.g. by a
+// process killed before cleaning up its challenges. Records created less than olderThan
+// ago are kept as they may belong to a running validation. Records of unknown age are kept
+// and reported with ErrRecordAgeUnknown, unless olderThan is 0 which deletes every record,
+// including the records of running validations. dns must implement xdns.RecordLister.
+//
+// The deleted records are returned, along with the errors of the records which failed to be
+// deleted or whose age is unknown.
+func SweepChallengeRecords(ctx context.Context, dns xdns.XDns, zone string, olderThan time.Duration) ([]xdns.Record, error) {
+	lister, ok := dns.(xdns.RecordLister)
+	if !ok {
+		return nil, ErrRecordListingUnsupported
+	}
+	records, err := lister.ListDomainRecords(zone, "TXT")
+	if err != nil {
+		return nil, fmt.Errorf("cupx/xacme.SweepChallengeRecords: list records of %s: %w", zone, err)
+	}
+
+	now := time.Now()
+	var deleted []xdns.Record
+	var errs []error
+	for _, r := range records {
+		if !isChallengeRecord(r) {
+			continue
+		}
+		if olderThan > 0 && r.CreatedAt.IsZero() {
+			errs = append(errs, fmt.Errorf("cupx/xacme.SweepChallengeRecords: %s %s: %w", r.Name, r.Value, ErrRecordAgeUnknown))
+			continue
+		}
+		if olderThan > 0 && now.Sub(r.CreatedAt) < olderThan {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return deleted, joinErrors(append(errs, err)...)
+		}
+		if err := dns.DnsDeleteDomainRecordByID(r.ID); err != nil {
+			errs = append(errs, fmt.Errorf("cupx/xacme.SweepChallengeRecords: delete %s %s: %w", r.Name, r.Value, err))
+			continue
+		}
+		deleted = append(deleted, r)
+	}
+	return deleted, joinErrors(errs...)
+}
+
+func isChallengeRecord(r xdns.Record) bool {
+	if !strings.EqualFold(r.Type, "TXT") {
+		return false
+	}
+	name := strings.ToLower(strings.TrimSuffix(r.Name, "."))
+	return name == challengeLabel || strings.HasPrefix(name, challengeLabel+".")
+}
@@ -0,0 +1,106 @@
+// Copyright 2020 The CupX Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xacme
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"cupx.github.io/pkg/xdns"
+)
+
+// listXDns lists records and deletes them by ID.
+type listXDns struct {
+	fakeXDns
+	records   []xdns.Record
+	deleted   []string
+	deleteErr map[string]error
+}
+
+func (x *listXDns) ListDomainRecords(zone string, t string) ([]xdns.Record, error) {
+	var records []xdns.Record
+	for _, r := range x.records {
+		if t == "" || r.Type == t {
+			records = append(records, r)
+		}
+	}
+	return records, nil
+}
+
+func (x *listXDns) DnsDeleteDomainRecordByID(id string) error {
+	if err := x.deleteErr[id]; err != nil {
+		return err
+	}
+	x.deleted = append(x.deleted, id)
+	return nil
+}
+
+func TestSweepChallengeRecords(t *testing.T) {
+	now := time.Now()
+	records := []xdns.Record{
+		{ID: "old", Type: "TXT", Name: "_acme-challenge.www.example.com", Value: "a", CreatedAt: now.Add(-2 * time.Hour)},
+		{ID: "new", Type: "TXT", Name: "_acme-challenge.example.com", Value: "b", CreatedAt: now.Add(-time.Minute)},
+		{ID: "unknown", Type: "TXT", Name: "_Acme-Challenge.example.com", Value: "c"},
+		{ID: "other", Type: "TXT", Name: "example.com", Value: "v=spf1 -all", CreatedAt: now.Add(-2 * time.Hour)},
+		{ID: "cname", Type: "CNAME", Name: "_acme-challenge.api.example.com", Value: "x.example.net", CreatedAt: now.Add(-2 * time.Hour)},
+		{ID: "label", Type: "TXT", Name: "_acme-challenge-x.example.com", Value: "d", CreatedAt: now.Add(-2 * time.Hour)},
+	}
+	tests := []struct {
+		name      string
+		olderThan time.Duration
+		want      []string
+		wantErr   error
+	}{
+		{"older than an hour", time.Hour, []string{"old"}, ErrRecordAgeUnknown},
+		{"all", 0, []string{"old", "new", "unknown"}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			x := &listXDns{records: records}
+			deleted, err := SweepChallengeRecords(context.Background(), x, "example.com", tt.olderThan)
+			if !errors.Is(err, tt.wantErr) || (err != nil) != (tt.wantErr != nil) {
+				t.Errorf("SweepChallengeRecords() err = %v, want %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(x.deleted, tt.want) {
+				t.Errorf("deleted = %v, want %v", x.deleted, tt.want)
+			}
+			if len(deleted) != len(tt.want) {
+				t.Errorf("SweepChallengeRecords() = %v", deleted)
+			}
+		})
+	}
+
+	t.Run("delete errors", func(t *testing.T) {
+		errDelete := errors.New("delete failed")
+		x := &listXDns{records: records, deleteErr: map[string]error{"old": errDelete}}
+		deleted, err := SweepChallengeRecords(context.Background(), x, "example.com", 0)
+		if !errors.Is(err, errDelete) {
+			t.Errorf("SweepChallengeRecords() err = %v, want %v", err, errDelete)
+		}
+		if len(deleted) != 2 {
+			t.Errorf("SweepChallengeRecords() = %v", deleted)
+		}
+	})
+
+	t.Run("unsupported", func(t *testing.T) {
+		_, err := SweepChallengeRecords(context.Background(), &fakeXDns{}, "example.com", 0)
+		if !errors.Is(err, ErrRecordListingUnsupported) {
+			t.Errorf("SweepChallengeRecords() err = %v, want %v", err, ErrRecordListingUnsupported)
+		}
+	})
+}
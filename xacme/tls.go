@@ -0,0 +1,312 @@
+// Copyright 2020 The CupX Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xacme
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// ErrHostNotAllowed is returned by the HostPolicy of HostWhitelist for hosts not in the list.
+var ErrHostNotAllowed = errors.New("cupx/xacme: host not allowed")
+
+// onDemandTimeout bounds the issuance of a certificate during a handshake.
+const onDemandTimeout = time.Minute * 5
+
+// storageCertReload is how long a certificate loaded from storage is served before it is
+// loaded again, as it may be renewed by another process.
+const storageCertReload = time.Minute * 10
+
+// HostPolicy decides whether a certificate may be issued on demand for host,
+// it returns an error to refuse it.
+type HostPolicy func(ctx context.Context, host string) error
+
+// HostWhitelist returns HostPolicy allowing only hosts, compared case-insensitively.
+// Internationalized names must be given in punycode.
+func HostWhitelist(hosts ...string) HostPolicy {
+	allowed := make(map[string]bool, len(hosts))
+	for _, h := range hosts {
+		allowed[strings.ToLower(strings.TrimSuffix(h, "."))] = true
+	}
+	return func(ctx context.Context, host string) error {
+		if !allowed[strings.ToLower(host)] {
+			return fmt.Errorf("%w: %s", ErrHostNotAllowed, host)
+		}
+		return nil
+	}
+}
+
+// tlsCert is a certificate parsed for GetCertificate.
+type tlsCert struct {
+	info *CertInfo
+	cert *tls.Certificate
+	// expires is when the certificate is no longer served from the cache.
+	expires time.Time
+}
+
+// failedIssue is a failed on-demand issuance.
+type failedIssue struct {
+	err      error
+	failures int
+	retryAt  time.Time
+}
+
+// pendingCert is a GetCertificate lookup shared by concurrent handshakes of a host.
+type pendingCert struct {
+	done chan struct{}
+	cert *tls.Certificate
+	err  error
+}
+
+// GetCertificate returns the certificate of the server name of hello, it is meant to be
+// tls.Config.GetCertificate. The managed certificates are served first, then the
+// certificates stored in Storage under CertName of the server name or of its wildcard,
+// i.e. the certificates whose first identifier is either.
+// If there is none and HostPolicy allows the host, a certificate is issued on demand,
+// stored and managed under the host. Concurrent handshakes of a host wait for the same
+// lookup, and the parsed certificates are cached until they are renewed. A failed issuance
+// is not retried for the host before the backoff of MinBackoff and MaxBackoff, so that
+// handshakes don't flood the CA with orders.
+//
+// Compose it with TLSALPNResponder.TLSConfig to answer tls-alpn-01 challenges as well.
+func (m *Manager) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	host := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+	if host == "" {
+		return nil, errors.New("cupx/xacme.Manager.GetCertificate: missing server name")
+	}
+	if strings.ContainsAny(host, `*/\`) || strings.HasPrefix(host, ".") {
+		return nil, fmt.Errorf("cupx/xacme.Manager.GetCertificate: invalid server name %q", host)
+	}
+	if cert, err := m.cachedCert(host); cert != nil || err != nil {
+		return cert, err
+	}
+
+	m.mu.Lock()
+	if p, ok := m.pending[host]; ok {
+		m.mu.Unlock()
+		<-p.done
+		return p.cert, p.err
+	}
+	p := &pendingCert{done: make(chan struct{})}
+	if m.pending == nil {
+		m.pending = make(map[string]*pendingCert)
+	}
+	m.pending[host] = p
+	m.mu.Unlock()
+
+	p.cert, p.err = m.cachedCert(host)
+	if p.cert == nil && p.err == nil {
+		p.cert, p.err = m.loadCert(host)
+	}
+
+	m.mu.Lock()
+	delete(m.pending, host)
+	m.mu.Unlock()
+	close(p.done)
+	return p.cert, p.err
+}
+
+// cachedCert returns the certificate of host managed by m or cached from Storage,
+// nil if there is none.
+func (m *Manager) cachedCert(host string) (*tls.Certificate, error) {
+	now := m.clock().Now()
+	for _, name := range certNames(host) {
+		m.mu.Lock()
+		info := m.managedCertOf(name)
+		c := m.tlsCerts[name]
+		m.mu.Unlock()
+
+		if info != nil {
+			if c != nil && c.info == info {
+				return c.cert, nil
+			}
+			cert, err := newTLSCert(info)
+			if err != nil {
+				return nil, fmt.Errorf("cupx/xacme.Manager.GetCertificate: %s: %w", name, err)
+			}
+			m.cacheCert(name, &tlsCert{info: info, cert: cert})
+			return cert, nil
+		}
+		if c != nil && now.Before(c.expires) {
+			return c.cert, nil
+		}
+	}
+	return nil, nil
+}
+
+// loadCert loads the certificate of host from Storage, or issues it on demand.
+func (m *Manager) loadCert(host string) (*tls.Certificate, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), onDemandTimeout)
+	defer cancel()
+
+	if m.Storage != nil {
+		for _, name := range certNames(host) {
+			info, err := LoadCert(ctx, m.Storage, CertName([]IdlIdentifier{{Value: name}}))
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			if err != nil {
+				return nil, fmt.Errorf("cupx/xacme.Manager.GetCertificate: %s: %w", name, err)
+			}
+			cert, err := newTLSCert(info)
+			if err != nil {
+				return nil, fmt.Errorf("cupx/xacme.Manager.GetCertificate: %s: %w", name, err)
+			}
+			now := m.clock().Now()
+			if !now.Before(cert.Leaf.NotAfter) {
+				// expired, e.g. left behind by a certificate no longer in use.
+				continue
+			}
+			expires := now.Add(storageCertReload)
+			if cert.Leaf.NotAfter.Before(expires) {
+				expires = cert.Leaf.NotAfter
+			}
+			m.cacheCert(name, &tlsCert{info: info, cert: cert, expires: expires})
+			return cert, nil
+		}
+	}
+
+	if m.HostPolicy == nil {
+		return nil, fmt.Errorf("cupx/xacme.Manager.GetCertificate: no certificate for %s", host)
+	}
+	if err := m.HostPolicy(ctx, host); err != nil {
+		return nil, fmt.Errorf("cupx/xacme.Manager.GetCertificate: %w", err)
+	}
+
+	m.mu.Lock()
+	f := m.failed[host]
+	m.mu.Unlock()
+	if f != nil && m.clock().Now().Before(f.retryAt) {
+		return nil, f.err
+	}
+	cert, err := m.issueOnDemand(ctx, host)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err != nil {
+		if m.failed == nil {
+			m.failed = make(map[string]*failedIssue)
+		}
+		failures := 1
+		if f != nil {
+			failures = f.failures + 1
+		}
+		retryAt := m.clock().Now().Add(m.backoff(failures))
+		err = fmt.Errorf("%w, not retried before %s", err, retryAt.Format(time.RFC3339))
+		m.failed[host] = &failedIssue{err: err, failures: failures, retryAt: retryAt}
+		return nil, err
+	}
+	delete(m.failed, host)
+	return cert, nil
+}
+
+// issueOnDemand issues the certificate of host, stores it and manages it under host.
+func (m *Manager) issueOnDemand(ctx context.Context, host string) (*tls.Certificate, error) {
+	sr := &IdlSignReq{Identifiers: []IdlIdentifier{{Type: IdentifierTypeDNS, Value: host}}}
+	info, err := m.issue(ctx, sr)
+	if err != nil {
+		return nil, fmt.Errorf("cupx/xacme.Manager.GetCertificate: issue certificate for %s: %w", host, err)
+	}
+	cert, err := newTLSCert(info)
+	if err != nil {
+		return nil, fmt.Errorf("cupx/xacme.Manager.GetCertificate: %s: %w", host, err)
+	}
+	// cached first, so that handshakes finding it managed share the parsed certificate.
+	m.cacheCert(host, &tlsCert{info: info, cert: cert})
+	if err := m.Manage(host, sr, info); err != nil {
+		return nil, err
+	}
+
+	var storeErr error
+	if m.Storage != nil {
+		storeErr = StoreCert(ctx, m.Storage, CertName(sr.Identifiers), info)
+	}
+	if m.OnRenewed != nil {
+		m.OnRenewed(host, info)
+	}
+	if storeErr != nil && m.OnFailure != nil {
+		renewAt, _ := m.RenewalTime(host)
+		m.OnFailure(host, fmt.Errorf("cupx/xacme.Manager: store certificate: %w", storeErr), renewAt)
+	}
+	return cert, nil
+}
+
+// managedCertOf returns the current certificate managed for name, m.mu must be held.
+func (m *Manager) managedCertOf(name string) *CertInfo {
+	if mc, ok := m.certs[name]; ok && mc.cert != nil && mc.sr.hasIdentifier(name) {
+		return mc.cert
+	}
+	for _, mc := range m.certs {
+		if mc.cert != nil && mc.sr.hasIdentifier(name) {
+			return mc.cert
+		}
+	}
+	return nil
+}
+
+func (m *Manager) cacheCert(name string, c *tlsCert) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.tlsCerts == nil {
+		m.tlsCerts = make(map[string]*tlsCert)
+	}
+	m.tlsCerts[name] = c
+}
+
+// hasIdentifier reports whether name is one of the identifiers of sr.
+func (sr *IdlSignReq) hasIdentifier(name string) bool {
+	for _, id := range sr.Identifiers {
+		if strings.EqualFold(strings.TrimSuffix(id.Value, "."), name) {
+			return true
+		}
+	}
+	return false
+}
+
+// certNames returns the names a certificate of host may be issued for, host and the
+// wildcard name of its parent domain.
+func certNames(host string) []string {
+	names := []string{host}
+	if i := strings.Index(host, "."); i > 0 && strings.Contains(host[i+1:], ".") {
+		names = append(names, "*"+host[i:])
+	}
+	return names
+}
+
+// newTLSCert returns the tls.Certificate of cert with its parsed leaf.
+func newTLSCert(cert *CertInfo) (*tls.Certificate, error) {
+	if cert.PemCertPrivateKey == "" {
+		return nil, errors.New("certificate has no private key")
+	}
+	chain := cert.PemCertBodyWithChain
+	if chain == "" {
+		chain = cert.PemCertBody + cert.PemCertChain
+	}
+	tlsCert, err := tls.X509KeyPair([]byte(chain), []byte(cert.PemCertPrivateKey))
+	if err != nil {
+		return nil, err
+	}
+	tlsCert.Leaf, err = x509.ParseCertificate(tlsCert.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	return &tlsCert, nil
+}
@@ -0,0 +1,220 @@
+// Copyright 2020 The CupX Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xacme
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"sync"
+	"testing"
+)
+
+func TestManager_GetCertificate(t *testing.T) {
+	ca := newFakeCA(t)
+	ca.enableOrders()
+	c := ca.newClient(WithSolver(ChallengeTypeDNS01, &recordSolver{}))
+	ctx := context.Background()
+
+	m := NewManager(c)
+	m.Storage = NewMemStorage()
+	hello := &tls.ClientHelloInfo{ServerName: "ondemand.test.xdns.cupx.net"}
+	if _, err := m.GetCertificate(hello); err == nil {
+		t.Error("GetCertificate() without HostPolicy err = nil")
+	}
+
+	var mu sync.Mutex
+	issued := 0
+	started := make(chan struct{})
+	release := make(chan struct{})
+	m.Issue = func(ctx context.Context, sr *IdlSignReq, opts ...Option) (*CertInfo, error) {
+		mu.Lock()
+		issued++
+		mu.Unlock()
+		close(started)
+		<-release
+		return c.SignCert(ctx, sr, opts...)
+	}
+	m.HostPolicy = HostWhitelist("OnDemand.test.xdns.cupx.net.")
+
+	// concurrent handshakes share the issuance.
+	certs := make([]*tls.Certificate, 5)
+	var wg sync.WaitGroup
+	for i := range certs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			cert, err := m.GetCertificate(&tls.ClientHelloInfo{ServerName: "OnDemand.test.xdns.cupx.net"})
+			if err != nil {
+				t.Error(err)
+			}
+			certs[i] = cert
+		}(i)
+	}
+	<-started
+	close(release)
+	wg.Wait()
+	if issued != 1 {
+		t.Errorf("issued %d certificates, want 1", issued)
+	}
+	for _, cert := range certs[1:] {
+		if cert != certs[0] {
+			t.Fatal("concurrent handshakes got different certificates")
+		}
+	}
+	if certs[0] == nil || certs[0].Leaf == nil || certs[0].Leaf.VerifyHostname("ondemand.test.xdns.cupx.net") != nil {
+		t.Fatalf("GetCertificate() = %v, want the certificate of the host", certs[0])
+	}
+
+	// the certificate is managed and stored under the host.
+	info := m.Certificate("ondemand.test.xdns.cupx.net")
+	if info == nil {
+		t.Fatal("certificate issued on demand is not managed")
+	}
+	if stored, err := LoadCert(ctx, m.Storage, "ondemand.test.xdns.cupx.net"); err != nil || stored.PemCertBody != info.PemCertBody {
+		t.Errorf("LoadCert() = %v, %v, want the issued certificate", stored, err)
+	}
+	if cert, err := m.GetCertificate(hello); err != nil || cert != certs[0] {
+		t.Errorf("GetCertificate() = %v, %v, want the cached certificate", cert, err)
+	}
+
+	if _, err := m.GetCertificate(&tls.ClientHelloInfo{ServerName: "other.test.xdns.cupx.net"}); !errors.Is(err, ErrHostNotAllowed) {
+		t.Errorf("GetCertificate() of a host not allowed err = %v, want %v", err, ErrHostNotAllowed)
+	}
+	for _, name := range []string{"", "*.test.xdns.cupx.net", "../test.xdns.cupx.net"} {
+		if _, err := m.GetCertificate(&tls.ClientHelloInfo{ServerName: name}); err == nil {
+			t.Errorf("GetCertificate(%q) err = nil", name)
+		}
+	}
+	if issued != 1 {
+		t.Errorf("issued %d certificates, want 1", issued)
+	}
+}
+
+func TestManager_GetCertificateStored(t *testing.T) {
+	ca := newFakeCA(t)
+	ca.enableOrders()
+	c := ca.newClient(WithSolver(ChallengeTypeDNS01, &recordSolver{}))
+	ctx := context.Background()
+
+	wildcard, err := c.SignCert(ctx, &IdlSignReq{Identifiers: []IdlIdentifier{{Type: "dns", Value: "www.stored.test.xdns.cupx.net"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := NewManager(c)
+	m.Storage = NewMemStorage()
+	if err := StoreCert(ctx, m.Storage, "_.stored.test.xdns.cupx.net", wildcard); err != nil {
+		t.Fatal(err)
+	}
+
+	// a stored wildcard certificate is served to the subdomains.
+	cert, err := m.GetCertificate(&tls.ClientHelloInfo{ServerName: "www.stored.test.xdns.cupx.net"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cert.Leaf == nil || string(cert.Leaf.Raw) != string(cert.Certificate[0]) {
+		t.Error("GetCertificate() leaf is not parsed")
+	}
+	if again, _ := m.GetCertificate(&tls.ClientHelloInfo{ServerName: "api.stored.test.xdns.cupx.net"}); again != cert {
+		t.Error("GetCertificate() of a stored certificate is not cached")
+	}
+
+	// managed certificates are matched by their identifiers and served once renewed.
+	sr := &IdlSignReq{Identifiers: []IdlIdentifier{{Type: "dns", Value: "managed.test.xdns.cupx.net"}}}
+	managed, err := c.SignCert(ctx, sr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Manage("managed", sr, managed); err != nil {
+		t.Fatal(err)
+	}
+	hello := &tls.ClientHelloInfo{ServerName: "managed.test.xdns.cupx.net"}
+	cert, err = m.GetCertificate(hello)
+	if err != nil || cert.Leaf.VerifyHostname("managed.test.xdns.cupx.net") != nil {
+		t.Fatalf("GetCertificate() = %v, %v, want the managed certificate", cert, err)
+	}
+	renewed, err := c.SignCert(ctx, sr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Manage("managed", sr, renewed); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := m.GetCertificate(hello); err != nil || got == cert || string(got.Certificate[0]) == string(cert.Certificate[0]) {
+		t.Errorf("GetCertificate() = %v, %v, want the renewed certificate", got, err)
+	}
+
+	m.Unmanage("managed")
+	if _, err := m.GetCertificate(hello); err == nil {
+		t.Error("GetCertificate() of an unmanaged certificate err = nil")
+	}
+
+	// a certificate renewed by another Manager under a name of its own is served.
+	other := NewManager(c)
+	other.Storage = m.Storage
+	renewed2 := make(chan *CertInfo, 1)
+	other.OnRenewed = func(name string, cert *CertInfo) {
+		renewed2 <- cert
+	}
+	rctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		_ = other.Run(rctx)
+	}()
+	if err := other.Manage("site1", &IdlSignReq{Identifiers: []IdlIdentifier{{Type: "dns", Value: "site1.test.xdns.cupx.net"}}}, nil); err != nil {
+		t.Fatal(err)
+	}
+	<-renewed2
+	cert, err = m.GetCertificate(&tls.ClientHelloInfo{ServerName: "site1.test.xdns.cupx.net"})
+	if err != nil || cert.Leaf.VerifyHostname("site1.test.xdns.cupx.net") != nil {
+		t.Errorf("GetCertificate() = %v, %v, want the certificate stored by the other Manager", cert, err)
+	}
+}
+
+func TestManager_GetCertificateBackoff(t *testing.T) {
+	clock := newFakeClock()
+	issued := 0
+	m := NewManager(nil)
+	m.Clock = clock
+	m.HostPolicy = HostWhitelist("failing.test.xdns.cupx.net")
+	m.Issue = func(ctx context.Context, sr *IdlSignReq, opts ...Option) (*CertInfo, error) {
+		issued++
+		return nil, ErrBadCSR
+	}
+
+	// a failed issuance is not retried by the handshakes before the backoff.
+	hello := &tls.ClientHelloInfo{ServerName: "failing.test.xdns.cupx.net"}
+	for i := 0; i < 3; i++ {
+		if _, err := m.GetCertificate(hello); !errors.Is(err, ErrBadCSR) {
+			t.Errorf("GetCertificate() err = %v, want %v", err, ErrBadCSR)
+		}
+	}
+	if issued != 1 {
+		t.Errorf("issued %d times, want 1", issued)
+	}
+
+	clock.AdvanceTo(clock.Now().Add(m.MinBackoff))
+	if _, err := m.GetCertificate(hello); !errors.Is(err, ErrBadCSR) {
+		t.Errorf("GetCertificate() err = %v, want %v", err, ErrBadCSR)
+	}
+	if issued != 2 {
+		t.Errorf("issued %d times after the backoff, want 2", issued)
+	}
+	// the backoff doubles with every failure.
+	clock.AdvanceTo(clock.Now().Add(m.MinBackoff))
+	if _, err := m.GetCertificate(hello); !errors.Is(err, ErrBadCSR) || issued != 2 {
+		t.Errorf("GetCertificate() err = %v, issued %d times, want %v and 2", err, issued, ErrBadCSR)
+	}
+}
@@ -0,0 +1,194 @@
+// Copyright 2020 The CupX Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xacme
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"math/big"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ACMETLS1Protocol is the ALPN protocol of tls-alpn-01 challenges, see rfc8737.
+// https://tools.ietf.org/html/rfc8737
+const ACMETLS1Protocol = "acme-tls/1"
+
+// idPeAcmeIdentifier is the id-pe-acmeIdentifier extension OID.
+var idPeAcmeIdentifier = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 1, 31}
+
+// NewTLSALPNChallengeCert returns the self-signed tls-alpn-01 validation certificate of domain.
+// If domain is an ip address, it goes into the ip address SAN, see rfc8738 section 6.
+func NewTLSALPNChallengeCert(domain string, keyAuth string) (*tls.Certificate, error) {
+	digest := sha256.Sum256([]byte(keyAuth))
+	extValue, err := asn1.Marshal(digest[:])
+	if err != nil {
+		return nil, err
+	}
+
+	priKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		ExtraExtensions: []pkix.Extension{
+			{
+				Id:       idPeAcmeIdentifier,
+				Critical: true,
+				Value:    extValue,
+			},
+		},
+	}
+	if ip := net.ParseIP(domain); ip != nil {
+		tmpl.IPAddresses = []net.IP{ip}
+	} else {
+		tmpl.Subject.CommonName = domain
+		tmpl.DNSNames = []string{domain}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &priKey.PublicKey, priKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  priKey,
+	}, nil
+}
+
+// TLSALPNResponder answers acme-tls/1 handshakes while tls-alpn-01 challenges are pending.
+// It implements Solver.
+type TLSALPNResponder struct {
+	mu    sync.RWMutex
+	certs map[string]*tls.Certificate
+}
+
+// NewTLSALPNResponder returns TLSALPNResponder.
+func NewTLSALPNResponder() *TLSALPNResponder {
+	return &TLSALPNResponder{certs: make(map[string]*tls.Certificate)}
+}
+
+// Present builds the validation certificate of ch and serves it until CleanUp.
+func (r *TLSALPNResponder) Present(ctx context.Context, ch *Challenge) error {
+	domain := ch.Identifier.Value
+	cert, err := NewTLSALPNChallengeCert(domain, ch.KeyAuthorization)
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.certs[tlsALPNServerName(domain)] = cert
+	return nil
+}
+
+func (r *TLSALPNResponder) Wait(ctx context.Context, ch *Challenge) error {
+	return nil
+}
+
+// CleanUp stops serving the validation certificate of ch.
+func (r *TLSALPNResponder) CleanUp(ctx context.Context, ch *Challenge) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.certs, tlsALPNServerName(ch.Identifier.Value))
+	return nil
+}
+
+// GetCertificate returns the validation certificate for acme-tls/1 handshakes.
+// It returns nil for other handshakes so that they are answered by tls.Config.Certificates.
+func (r *TLSALPNResponder) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if !isACMETLS1Hello(hello) {
+		return nil, nil
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	cert, ok := r.certs[strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))]
+	if !ok {
+		return nil, errors.New("cupx/xacme.TLSALPNResponder: no pending tls-alpn-01 challenge for " + hello.ServerName)
+	}
+	return cert, nil
+}
+
+// TLSConfig returns a copy of base which also answers acme-tls/1 handshakes.
+// Other handshakes are answered by base.GetCertificate or base.Certificates.
+// If base has no NextProtos, h2 and http/1.1 are offered besides acme-tls/1, so that
+// clients negotiating other protocols are still served.
+func (r *TLSALPNResponder) TLSConfig(base *tls.Config) *tls.Config {
+	var conf *tls.Config
+	if base != nil {
+		conf = base.Clone()
+	} else {
+		conf = &tls.Config{}
+	}
+
+	if len(conf.NextProtos) == 0 {
+		conf.NextProtos = []string{"h2", "http/1.1"}
+	}
+	conf.NextProtos = append(conf.NextProtos, ACMETLS1Protocol)
+
+	next := conf.GetCertificate
+	conf.GetCertificate = func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		if isACMETLS1Hello(hello) {
+			return r.GetCertificate(hello)
+		}
+		if next != nil {
+			return next(hello)
+		}
+		return nil, nil
+	}
+
+	return conf
+}
+
+// tlsALPNServerName returns the SNI of the tls-alpn-01 validation of identifier,
+// the reverse dns name for ip addresses, see rfc8738 section 6.
+func tlsALPNServerName(identifier string) string {
+	if ip := net.ParseIP(identifier); ip != nil {
+		return ReverseName(ip)
+	}
+	return strings.ToLower(identifier)
+}
+
+func isACMETLS1Hello(hello *tls.ClientHelloInfo) bool {
+	return len(hello.SupportedProtos) == 1 && hello.SupportedProtos[0] == ACMETLS1Protocol
+}
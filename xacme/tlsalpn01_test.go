@@ -0,0 +1,150 @@
+// Copyright 2020 The CupX Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xacme
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/asn1"
+	"net"
+	"testing"
+)
+
+func TestTLSALPNResponder(t *testing.T) {
+	r := NewTLSALPNResponder()
+	ch := &Challenge{
+		Type:             ChallengeTypeTLSALPN01,
+		Identifier:       IdlIdentifier{Type: "dns", Value: "alpn.test.xdns.cupx.net"},
+		KeyAuthorization: "token.thumbprint",
+	}
+	if err := r.Present(context.Background(), ch); err != nil {
+		t.Fatal(err)
+	}
+
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", r.TLSConfig(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			_ = conn.(*tls.Conn).Handshake()
+			_ = conn.Close()
+		}
+	}()
+
+	conn, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{
+		ServerName:         "alpn.test.xdns.cupx.net",
+		NextProtos:         []string{ACMETLS1Protocol},
+		InsecureSkipVerify: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	state := conn.ConnectionState()
+	_ = conn.Close()
+
+	if state.NegotiatedProtocol != ACMETLS1Protocol {
+		t.Errorf("NegotiatedProtocol = %v, want %v", state.NegotiatedProtocol, ACMETLS1Protocol)
+	}
+	cert := state.PeerCertificates[0]
+	if len(cert.DNSNames) != 1 || cert.DNSNames[0] != "alpn.test.xdns.cupx.net" {
+		t.Errorf("DNSNames = %v", cert.DNSNames)
+	}
+
+	want := sha256.Sum256([]byte("token.thumbprint"))
+	found := false
+	for _, ext := range cert.Extensions {
+		if !ext.Id.Equal(idPeAcmeIdentifier) {
+			continue
+		}
+		found = true
+		var got []byte
+		if _, err := asn1.Unmarshal(ext.Value, &got); err != nil {
+			t.Fatal(err)
+		}
+		if !ext.Critical || !bytes.Equal(got, want[:]) {
+			t.Errorf("acmeIdentifier extension = %x critical %v, want %x", got, ext.Critical, want)
+		}
+	}
+	if !found {
+		t.Error("acmeIdentifier extension not found")
+	}
+
+	_ = r.CleanUp(context.Background(), ch)
+	_, err = r.GetCertificate(&tls.ClientHelloInfo{
+		ServerName:      "alpn.test.xdns.cupx.net",
+		SupportedProtos: []string{ACMETLS1Protocol},
+		Conn:            &net.TCPConn{},
+	})
+	if err == nil {
+		t.Error("GetCertificate() after CleanUp err = nil")
+	}
+}
+
+func TestTLSALPNResponder_TLSConfig(t *testing.T) {
+	certPEM, keyPEM := newTestCert(t, "www.test.xdns.cupx.net")
+	cert, err := tls.X509KeyPair([]byte(certPEM), []byte(keyPEM))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := NewTLSALPNResponder()
+
+	// handshakes of other protocols are answered by base.
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", r.TLSConfig(&tls.Config{Certificates: []tls.Certificate{cert}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			_ = conn.(*tls.Conn).Handshake()
+			_ = conn.Close()
+		}
+	}()
+
+	conn, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{
+		ServerName:         "www.test.xdns.cupx.net",
+		NextProtos:         []string{"h2", "http/1.1"},
+		InsecureSkipVerify: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	state := conn.ConnectionState()
+	_ = conn.Close()
+	if state.NegotiatedProtocol != "h2" {
+		t.Errorf("NegotiatedProtocol = %v, want h2", state.NegotiatedProtocol)
+	}
+	if !bytes.Equal(state.PeerCertificates[0].Raw, cert.Certificate[0]) {
+		t.Error("handshake not answered with the certificate of base")
+	}
+
+	// NextProtos of base are kept.
+	conf := r.TLSConfig(&tls.Config{NextProtos: []string{"http/1.1"}})
+	if len(conf.NextProtos) != 2 || conf.NextProtos[0] != "http/1.1" || conf.NextProtos[1] != ACMETLS1Protocol {
+		t.Errorf("NextProtos = %v", conf.NextProtos)
+	}
+}
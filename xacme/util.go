@@ -15,23 +15,33 @@
 package xacme
 
 import (
+	"context"
 	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
 	"crypto/sha256"
+	"crypto/x509"
 	"encoding/base64"
+	"encoding/pem"
+	"errors"
 	"fmt"
 	"strings"
+	"time"
 
+	xed25519 "golang.org/x/crypto/ed25519"
 	"gopkg.in/square/go-jose.v2"
 )
 
 func GetJWKThumbprintWithBase64url(key interface{}) (string, error) {
 	j := jose.JSONWebKey{
-		Key: key,
+		Key: joseKey(key),
 	}
 
 	jd, err := j.Thumbprint(crypto.SHA256)
 	if err != nil {
-		return "", nil
+		return "", err
 	}
 
 	return base64.RawURLEncoding.EncodeToString(jd), nil
@@ -106,3 +116,123 @@ func FmtX509KeyID(id []byte) string {
 	}
 	return s
 }
+
+// ParsePemPrivateKey parses a PKCS#1, PKCS#8 or SEC1 pem encoded private key.
+func ParsePemPrivateKey(pemKey string) (crypto.Signer, error) {
+	block, _ := pem.Decode([]byte(pemKey))
+	if block == nil {
+		return nil, errors.New("cupx/xacme.ParsePemPrivateKey: no pem block found")
+	}
+
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		return x509.ParseECPrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		signer, ok := key.(crypto.Signer)
+		if !ok {
+			return nil, fmt.Errorf("cupx/xacme.ParsePemPrivateKey: unsupported key type %T", key)
+		}
+		return signer, nil
+	}
+
+	return nil, errors.New("cupx/xacme.ParsePemPrivateKey: unsupported pem type " + block.Type)
+}
+
+// MarshalPemPrivateKey returns the pem encoding of key, SEC1 for ecdsa keys and PKCS#8 for others.
+func MarshalPemPrivateKey(key crypto.Signer) (string, error) {
+	var block *pem.Block
+	switch k := key.(type) {
+	case *ecdsa.PrivateKey:
+		b, err := x509.MarshalECPrivateKey(k)
+		if err != nil {
+			return "", err
+		}
+		block = &pem.Block{Type: "EC PRIVATE KEY", Bytes: b}
+	default:
+		b, err := x509.MarshalPKCS8PrivateKey(k)
+		if err != nil {
+			return "", err
+		}
+		block = &pem.Block{Type: "PRIVATE KEY", Bytes: b}
+	}
+	return string(pem.EncodeToMemory(block)), nil
+}
+
+// jwsAlgorithm returns the JWS algorithm of key.
+func jwsAlgorithm(key crypto.Signer) (jose.SignatureAlgorithm, error) {
+	switch k := key.(type) {
+	case *ecdsa.PrivateKey:
+		if k == nil {
+			break
+		}
+		switch k.Curve {
+		case elliptic.P256():
+			return jose.ES256, nil
+		case elliptic.P384():
+			return jose.ES384, nil
+		case elliptic.P521():
+			return jose.ES512, nil
+		}
+	case *rsa.PrivateKey:
+		if k == nil {
+			break
+		}
+		if k.N.BitLen() < 2048 {
+			return "", fmt.Errorf("cupx/xacme: rsa key of %d bits is too small", k.N.BitLen())
+		}
+		return jose.RS256, nil
+	case ed25519.PrivateKey:
+		return jose.EdDSA, nil
+	}
+
+	return "", fmt.Errorf("cupx/xacme: unsupported key type %T", key)
+}
+
+// joseKey returns key in the form go-jose accepts. go-jose only knows the ed25519 keys
+// of golang.org/x/crypto, which are distinct from crypto/ed25519 before go1.13 aliases.
+func joseKey(key interface{}) interface{} {
+	switch k := key.(type) {
+	case ed25519.PrivateKey:
+		return xed25519.PrivateKey(k)
+	case ed25519.PublicKey:
+		return xed25519.PublicKey(k)
+	}
+	return key
+}
+
+// sleepContext sleeps for d, it returns ctx.Err() if ctx is done first.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+// cleanupTimeout bounds the cleanup run after the context of an issuance is done.
+const cleanupTimeout = time.Minute
+
+// cleanupContext returns a context for cleaning up after ctx. It keeps the values of ctx
+// but is not canceled with it, so that cleanup still runs when the issuance is canceled.
+func cleanupContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(detachedContext{ctx}, cleanupTimeout)
+}
+
+// detachedContext carries the values of a context without its deadline and cancellation.
+type detachedContext struct {
+	parent context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool)         { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}               { return nil }
+func (detachedContext) Err() error                          { return nil }
+func (c detachedContext) Value(key interface{}) interface{} { return c.parent.Value(key) }
@@ -18,10 +18,19 @@ package alidns
 import (
 	"cupx.github.io/pkg/xdns/xdnsutil"
 	"strings"
+	"time"
 
+	"github.com/aliyun/alibaba-cloud-sdk-go/sdk/requests"
 	"github.com/aliyun/alibaba-cloud-sdk-go/services/alidns"
 )
 
+// listPageSize is the maximum page size of DescribeDomainRecords.
+const listPageSize = 500
+
+// createdRemarkPrefix prefixes the creation time AddDomainRecord writes to the remark of a
+// record, as alidns doesn't tell when a record was created.
+const createdRemarkPrefix = "cupx/xdns created "
+
 // AliDns implements XDns interface.
 type AliDns struct {
 	AK     string
@@ -56,7 +65,7 @@ func (d *AliDns) AddDomainRecord(t string, name string, value string) error {
 	req.DomainName = rootZone
 	req.RR = rr
 	req.Value = value
-	_, err := d.client.AddDomainRecord(req)
+	resp, err := d.client.AddDomainRecord(req)
 	if err != nil {
 		if strings.Contains(err.Error(), "ErrorCode: DomainRecordDuplicate") {
 			return nil
@@ -64,6 +73,13 @@ func (d *AliDns) AddDomainRecord(t string, name string, value string) error {
 		return err
 	}
 
+	// the record is created, failing to note its creation time only leaves its age unknown.
+	remark := alidns.CreateUpdateDomainRecordRemarkRequest()
+	remark.Scheme = "https"
+	remark.RecordId = resp.RecordId
+	remark.Remark = createdRemarkPrefix + time.Now().UTC().Format(time.RFC3339)
+	_, _ = d.client.UpdateDomainRecordRemark(remark)
+
 	return nil
 }
 
@@ -113,6 +129,55 @@ func (d *AliDns) AliDnsGetDomainRecordList(name string) (*alidns.DescribeDomainR
 
 }
 
+// ListDomainRecords lists the records of type t in zone, all types if t is empty.
+// CreatedAt is read from the remark written by AddDomainRecord, it is zero for the
+// records created otherwise.
+func (d *AliDns) ListDomainRecords(zone string, t string) ([]xdnsutil.Record, error) {
+	var records []xdnsutil.Record
+	for page := 1; ; page++ {
+		req := alidns.CreateDescribeDomainRecordsRequest()
+		req.Scheme = "https"
+		req.DomainName = zone
+		req.TypeKeyWord = t
+		req.PageNumber = requests.NewInteger(page)
+		req.PageSize = requests.NewInteger(listPageSize)
+
+		resp, err := d.client.DescribeDomainRecords(req)
+		if err != nil {
+			return nil, err
+		}
+		for _, v := range resp.DomainRecords.Record {
+			name := v.DomainName
+			if v.RR != "@" {
+				name = v.RR + "." + v.DomainName
+			}
+			records = append(records, xdnsutil.Record{
+				ID:        v.RecordId,
+				Type:      v.Type,
+				Name:      name,
+				Value:     v.Value,
+				CreatedAt: remarkCreatedAt(v.Remark),
+			})
+		}
+		if len(resp.DomainRecords.Record) < listPageSize || int64(len(records)) >= resp.TotalCount {
+			return records, nil
+		}
+	}
+}
+
+// remarkCreatedAt returns the creation time in remark written by AddDomainRecord,
+// zero if there is none.
+func remarkCreatedAt(remark string) time.Time {
+	if !strings.HasPrefix(remark, createdRemarkPrefix) {
+		return time.Time{}
+	}
+	t, err := time.Parse(time.RFC3339, strings.TrimPrefix(remark, createdRemarkPrefix))
+	if err != nil {
+		return time.Time{}
+	}
+	return t
+}
+
 func (d *AliDns) GetRootZone(name string) string {
 
 	for i := 0; ; i++ {
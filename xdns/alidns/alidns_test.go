@@ -17,6 +17,7 @@ package alidns
 import (
 	"log"
 	"testing"
+	"time"
 
 	"cupx.github.io/pkg/xdns/alidns/testdata"
 )
@@ -50,3 +51,21 @@ func TestAliDns_DeleteDomainRecord(t *testing.T) {
 	d := newClient()
 	log.Println(d.DeleteDomainRecord("TXT", "q.w.dc.x.test.xdns.cupx.net", "test"))
 }
+
+func TestRemarkCreatedAt(t *testing.T) {
+	created := time.Date(2020, 12, 1, 8, 30, 0, 0, time.UTC)
+	tests := []struct {
+		remark string
+		want   time.Time
+	}{
+		{createdRemarkPrefix + created.Format(time.RFC3339), created},
+		{"", time.Time{}},
+		{"set by hand", time.Time{}},
+		{createdRemarkPrefix + "yesterday", time.Time{}},
+	}
+	for _, tt := range tests {
+		if got := remarkCreatedAt(tt.remark); !got.Equal(tt.want) {
+			t.Errorf("remarkCreatedAt(%q) = %v, want %v", tt.remark, got, tt.want)
+		}
+	}
+}
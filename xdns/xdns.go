@@ -15,7 +15,10 @@
 // Package xdns provides an extensible dns library
 package xdns
 
-import "cupx.github.io/pkg/xdns/alidns"
+import (
+	"cupx.github.io/pkg/xdns/alidns"
+	"cupx.github.io/pkg/xdns/xdnsutil"
+)
 
 // Config configures XDns when creating.
 type Config struct {
@@ -34,6 +37,15 @@ type XDns interface {
 	DnsDeleteDomainRecordByID(id string) error
 }
 
+// Record is a dns record listed by RecordLister.
+type Record = xdnsutil.Record
+
+// RecordLister is implemented by XDns which can list the records of a zone.
+type RecordLister interface {
+	// ListDomainRecords lists the records of type t in zone, all types if t is empty.
+	ListDomainRecords(zone string, t string) ([]Record, error)
+}
+
 // NewXDns returns XDns.
 func NewXDns(conf *Config) XDns {
 	if conf.Type == "alidns" {
@@ -15,7 +15,21 @@
 // Package xdnsutil provides a utility library for XDns.
 package xdnsutil
 
-import "strings"
+import (
+	"strings"
+	"time"
+)
+
+// Record is a dns record listed from a dns server.
+type Record struct {
+	ID   string
+	Type string
+	// Name is the full name of the record, e.g. _acme-challenge.www.example.com.
+	Name  string
+	Value string
+	// CreatedAt is when the record was created, zero if the dns server doesn't tell.
+	CreatedAt time.Time
+}
 
 func TrimSubDomain(name string, n int) string {
 	s := strings.Split(name, ".")